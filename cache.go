@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheEntry is a cached value and its expiry.
+type cacheEntry struct {
+	value     any
+	expiresAt time.Time
+}
+
+// Cache is an in-memory cache whose entries expire after a fixed TTL.
+type Cache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+
+	hits, misses, evictions uint64
+}
+
+// CacheStats counts the lookups of a cache.
+type CacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+
+	// Evictions counts the entries dropped because they expired.
+	Evictions uint64 `json:"evictions"`
+
+	// Size is the current number of entries, expired ones included until
+	// they are next looked up or swept.
+	Size int `json:"size"`
+}
+
+// NewCache creates a cache whose entries expire after ttl.
+func NewCache(ttl time.Duration) *Cache {
+	return &Cache{ttl: ttl, entries: make(map[string]cacheEntry)}
+}
+
+// Get returns the value cached under key, if it has not expired.
+func (c *Cache) Get(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	if time.Now().After(e.expiresAt) {
+		delete(c.entries, key)
+		atomic.AddUint64(&c.evictions, 1)
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return e.value, true
+}
+
+// Stats returns the lookup counters and the size of the cache.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	size := len(c.entries)
+	c.mu.Unlock()
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+		Size:      size,
+	}
+}
+
+// Set caches value under key.
+func (c *Cache) Set(key string, value any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = cacheEntry{value: value, expiresAt: time.Now().Add(c.ttl)}
+}
+
+// Sweep drops the expired entries every interval until ctx is done, so
+// that the entries which are never looked up again do not pile up.
+func (c *Cache) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			for key, e := range c.entries {
+				if now.After(e.expiresAt) {
+					delete(c.entries, key)
+					atomic.AddUint64(&c.evictions, 1)
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// Clear drops every entry and returns how many there were.
+func (c *Cache) Clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.entries)
+	c.entries = make(map[string]cacheEntry)
+	return n
+}
+
+// CachedRepository caches province and city reads of the wrapped
+// repository. Writes made through it clear the cache; changes made out of
+// band are picked up when entries expire or on Invalidate.
+type CachedRepository struct {
+	RepositoryIface
+
+	cache *Cache
+
+	mu      sync.Mutex
+	version string
+}
+
+// NewCachedRepository wraps repo with a cache whose entries expire after ttl.
+func NewCachedRepository(repo RepositoryIface, ttl time.Duration) *CachedRepository {
+	return &CachedRepository{RepositoryIface: repo, cache: NewCache(ttl)}
+}
+
+// Unwrap returns the wrapped repository.
+func (r *CachedRepository) Unwrap() RepositoryIface {
+	return r.RepositoryIface
+}
+
+// Stats returns the statistics of the cache.
+func (r *CachedRepository) Stats() CacheStats {
+	return r.cache.Stats()
+}
+
+// Sweep drops the expired entries of the cache every TTL until ctx is done.
+func (r *CachedRepository) Sweep(ctx context.Context) {
+	r.cache.Sweep(ctx, r.cache.ttl)
+}
+
+// Invalidate clears the cache and returns the number of entries cleared.
+func (r *CachedRepository) Invalidate() int {
+	return r.cache.Clear()
+}
+
+func (r *CachedRepository) GetProvinces(ctx context.Context, f ProvinceFilter) ([]Province, error) {
+	key := "provinces:" + provinceFilterKey(f)
+	if v, ok := r.cache.Get(key); ok {
+		return copyProvinces(v.([]Province)), nil
+	}
+	provinces, err := r.RepositoryIface.GetProvinces(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	r.cache.Set(key, copyProvinces(provinces))
+	return provinces, nil
+}
+
+func (r *CachedRepository) GetProvinceByID(ctx context.Context, provinceID int) (Province, error) {
+	key := fmt.Sprintf("province:%d", provinceID)
+	if v, ok := r.cache.Get(key); ok {
+		return copyProvince(v.(Province)), nil
+	}
+	p, err := r.RepositoryIface.GetProvinceByID(ctx, provinceID)
+	if err != nil {
+		return Province{}, err
+	}
+	r.cache.Set(key, copyProvince(p))
+	return p, nil
+}
+
+func (r *CachedRepository) GetCities(ctx context.Context, provinceID int, sort Sort, page Page, inactive bool) ([]City, error) {
+	key := fmt.Sprintf("cities:%d:%s:%d:%d:%t", provinceID, sort, page.Limit, page.Offset, inactive)
+	if v, ok := r.cache.Get(key); ok {
+		return copyCities(v.([]City)), nil
+	}
+	cities, err := r.RepositoryIface.GetCities(ctx, provinceID, sort, page, inactive)
+	if err != nil {
+		return nil, err
+	}
+	r.cache.Set(key, copyCities(cities))
+	return cities, nil
+}
+
+// DataVersion returns the version of the wrapped repository, clearing the
+// cache when it changed so that a new version is never served with data
+// cached under the previous one.
+func (r *CachedRepository) DataVersion(ctx context.Context) (string, error) {
+	v, err := r.RepositoryIface.DataVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if v != r.version {
+		if r.version != "" {
+			r.cache.Clear()
+		}
+		r.version = v
+	}
+	return v, nil
+}
+
+func (r *CachedRepository) CreateProvince(ctx context.Context, p Province) error {
+	defer r.cache.Clear()
+	return r.RepositoryIface.CreateProvince(ctx, p)
+}
+
+func (r *CachedRepository) ImportProvinces(ctx context.Context, provinces []Province) (map[int]bool, error) {
+	defer r.cache.Clear()
+	return r.RepositoryIface.ImportProvinces(ctx, provinces)
+}
+
+func (r *CachedRepository) DeleteProvinces(ctx context.Context, ids []int) (*BulkDeleteResult, error) {
+	defer r.cache.Clear()
+	return r.RepositoryIface.DeleteProvinces(ctx, ids)
+}
+
+func (r *CachedRepository) UpdateCity(ctx context.Context, cityID int, fields CityUpdate) (City, error) {
+	defer r.cache.Clear()
+	return r.RepositoryIface.UpdateCity(ctx, cityID, fields)
+}
+
+func (r *CachedRepository) UpdateProvince(ctx context.Context, provinceID int, fields ProvinceUpdate) (Province, error) {
+	defer r.cache.Clear()
+	return r.RepositoryIface.UpdateProvince(ctx, provinceID, fields)
+}
+
+func (r *CachedRepository) AddTag(ctx context.Context, provinceID int, tag string) error {
+	defer r.cache.Clear()
+	return r.RepositoryIface.AddTag(ctx, provinceID, tag)
+}
+
+func (r *CachedRepository) RemoveTag(ctx context.Context, provinceID int, tag string) error {
+	defer r.cache.Clear()
+	return r.RepositoryIface.RemoveTag(ctx, provinceID, tag)
+}
+
+// provinceFilterKey returns a cache key identifying the provinces selected
+// by f.
+func provinceFilterKey(f ProvinceFilter) string {
+	hasCities := "any"
+	if f.HasCities != nil {
+		hasCities = strconv.FormatBool(*f.HasCities)
+	}
+	return fmt.Sprintf("%q:%q:%t:%s:%t:%q:%q:%q:%q:%s:%d:%d",
+		f.Search, f.Lang, f.Fuzzy, hasCities, f.InactiveCities, f.Codes, f.Tag, f.Region, f.Fields, f.Sort, f.Page.Limit, f.Page.Offset)
+}
+
+// copyProvinces copies provinces so that callers cannot modify cached
+// values, along with their cities, city ids and tags.
+func copyProvinces(provinces []Province) []Province {
+	c := make([]Province, len(provinces))
+	for i, p := range provinces {
+		c[i] = copyProvince(p)
+	}
+	return c
+}
+
+// copyProvince copies the slices of p, keeping nil ones nil as they tell
+// that the data was not loaded.
+func copyProvince(p Province) Province {
+	if p.Cities != nil {
+		p.Cities = copyCities(p.Cities)
+	}
+	if p.CityIDs != nil {
+		p.CityIDs = append(make([]int, 0, len(p.CityIDs)), p.CityIDs...)
+	}
+	if p.Tags != nil {
+		p.Tags = append(make([]string, 0, len(p.Tags)), p.Tags...)
+	}
+	return p
+}
+
+// copyCities copies cities so that callers cannot modify cached values.
+func copyCities(cities []City) []City {
+	c := make([]City, len(cities))
+	copy(c, cities)
+	for i := range c {
+		if c[i].Active != nil {
+			active := *c[i].Active
+			c[i].Active = &active
+		}
+	}
+	return c
+}
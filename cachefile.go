@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func init() {
+	// The types of the cached values, which gob needs to decode them.
+	gob.Register([]Province(nil))
+	gob.Register(Province{})
+	gob.Register([]City(nil))
+}
+
+// cacheFile is the on-disk copy of a cache, tied to the data version its
+// entries were read at.
+type cacheFile struct {
+	Version string
+	Entries map[string]cacheFileEntry
+}
+
+// cacheFileEntry is a cached value and its expiry.
+type cacheFileEntry struct {
+	Value     any
+	ExpiresAt time.Time
+}
+
+// SaveFile writes the cache to the gob file at path, so that a restarted
+// process can load it instead of starting cold. The file is replaced
+// atomically, so a crash while saving leaves the previous one in place.
+func (r *CachedRepository) SaveFile(ctx context.Context, path string) error {
+	// Reading the version first clears the cache if the data moved on.
+	version, err := r.DataVersion(ctx)
+	if err != nil {
+		return err
+	}
+	f := cacheFile{Version: version, Entries: make(map[string]cacheFileEntry)}
+	now := time.Now()
+	r.cache.mu.Lock()
+	for key, e := range r.cache.entries {
+		if e.expiresAt.After(now) {
+			f.Entries[key] = cacheFileEntry{Value: e.value, ExpiresAt: e.expiresAt}
+		}
+	}
+	r.cache.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := gob.NewEncoder(tmp).Encode(f); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadFile fills the cache from the gob file at path written by SaveFile.
+// The file is discarded, leaving the cache empty, when it is missing,
+// corrupt, or was written at another data version than the current one.
+// Only a failure to read the current version is returned.
+func (r *CachedRepository) LoadFile(ctx context.Context, path string) error {
+	version, err := r.RepositoryIface.DataVersion(ctx)
+	if err != nil {
+		return err
+	}
+	f, err := readCacheFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil
+	case err != nil:
+		log.Printf("warning: discarding cache file %s: %v", path, err)
+		return nil
+	case f.Version != version:
+		log.Printf("discarding cache file %s: written at data version %s, now %s", path, f.Version, version)
+		return nil
+	}
+
+	now := time.Now()
+	r.cache.mu.Lock()
+	for key, e := range f.Entries {
+		if e.ExpiresAt.After(now) {
+			r.cache.entries[key] = cacheEntry{value: e.Value, expiresAt: e.ExpiresAt}
+		}
+	}
+	n := len(r.cache.entries)
+	r.cache.mu.Unlock()
+
+	r.mu.Lock()
+	r.version = version
+	r.mu.Unlock()
+	log.Printf("loaded %d cache entries from %s", n, path)
+	return nil
+}
+
+// readCacheFile decodes the cache file at path.
+func readCacheFile(path string) (cacheFile, error) {
+	var f cacheFile
+	file, err := os.Open(path)
+	if err != nil {
+		return f, err
+	}
+	defer file.Close()
+	if err := gob.NewDecoder(file).Decode(&f); err != nil {
+		return f, fmt.Errorf("decode: %w", err)
+	}
+	for key, e := range f.Entries {
+		switch e.Value.(type) {
+		case []Province, Province, []City:
+		default:
+			return f, fmt.Errorf("entry %q holds an unexpected %T", key, e.Value)
+		}
+	}
+	return f, nil
+}
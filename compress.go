@@ -0,0 +1,214 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/labstack/echo/v4"
+)
+
+// encoder is a compressing writer, as gzip.Writer and brotli.Writer are.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoders pools the writers of the supported encodings, the preferred one
+// first, as creating them allocates their whole window.
+var encoders = []struct {
+	name string
+	pool *sync.Pool
+}{
+	{"br", &sync.Pool{New: func() any { return brotli.NewWriter(nil) }}},
+	{"gzip", &sync.Pool{New: func() any { return gzip.NewWriter(nil) }}},
+}
+
+// negotiateEncoding returns the supported encoding the Accept-Encoding
+// header of r gives the highest weight, br winning ties; it is empty when
+// the client accepts none of them.
+func negotiateEncoding(r *http.Request) (string, *sync.Pool) {
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(r.Header.Get(echo.HeaderAcceptEncoding), ",") {
+		token, params, _ := strings.Cut(part, ";")
+		token = strings.ToLower(strings.TrimSpace(token))
+		if token == "" {
+			continue
+		}
+		q := 1.0
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				continue
+			}
+			q = v
+		}
+		weights[token] = q
+	}
+	star, hasStar := weights["*"]
+	var (
+		best  string
+		pool  *sync.Pool
+		bestQ float64
+	)
+	for _, enc := range encoders {
+		q, ok := weights[enc.name]
+		if !ok && hasStar {
+			q = star
+		}
+		if q > bestQ {
+			best, pool, bestQ = enc.name, enc.pool, q
+		}
+	}
+	return best, pool
+}
+
+// compress compresses the responses of at least minSize bytes with br or
+// gzip, as negotiated with Accept-Encoding. Shorter responses are sent as
+// is, since compressing them costs more than it saves.
+func compress(minSize int) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			res := c.Response()
+			encoding, pool := negotiateEncoding(c.Request())
+			w := &compressWriter{
+				ResponseWriter: res.Writer,
+				encoding:       encoding,
+				pool:           pool,
+				minSize:        minSize,
+			}
+			res.Writer = w
+			defer func() {
+				w.Close()
+				res.Writer = w.ResponseWriter
+			}()
+			// The error is handled here for the error response to be
+			// written before the writer is closed. It is still returned
+			// for the middleware before, e.g. to be logged.
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+			return err
+		}
+	}
+}
+
+// compressWriter holds back the start of a response until it reaches
+// minSize, then compresses it. A response ending or flushed before is sent
+// uncompressed or compressed respectively. Without an encoding, the
+// response is sent as is. Vary is set only when the header is written, as
+// the request timeout replaces the headers set before it.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	pool     *sync.Pool
+	minSize  int
+
+	status  int
+	buf     []byte
+	started bool
+	enc     encoder
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.started {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.started {
+		if w.enc != nil {
+			return w.enc.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if w.pool == nil || len(w.buf) >= w.minSize {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush sends what was written so far, compressing it as the response is
+// being streamed.
+func (w *compressWriter) Flush() {
+	if !w.started {
+		if err := w.start(true); err != nil {
+			return
+		}
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close sends the response if it is still held back and ends the
+// compressed stream.
+func (w *compressWriter) Close() error {
+	if !w.started {
+		if err := w.start(false); err != nil {
+			return err
+		}
+	}
+	if w.enc == nil {
+		return nil
+	}
+	err := w.enc.Close()
+	w.enc.Reset(nil)
+	w.pool.Put(w.enc)
+	w.enc = nil
+	return err
+}
+
+// start writes the header and the held back body, compressing from now on
+// if compressed is set and the response has a body to compress.
+func (w *compressWriter) start(compressed bool) error {
+	w.started = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	h := w.Header()
+	h.Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+	if compressed && w.pool != nil && h.Get(echo.HeaderContentEncoding) == "" && bodyAllowed(w.status) {
+		h.Set(echo.HeaderContentEncoding, w.encoding)
+		h.Del(echo.HeaderContentLength)
+		w.enc = w.pool.Get().(encoder)
+		w.enc.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(w.buf)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+// Unwrap returns the wrapped writer, for http.ResponseController.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// bodyAllowed reports whether a response with status may have a body.
+func bodyAllowed(status int) bool {
+	return status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified
+}
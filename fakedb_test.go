@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeResult is the result every query of a fake database returns: rows,
+// then err once they are read, as a connection lost mid-iteration would.
+type fakeResult struct {
+	columns []string
+	rows    [][]driver.Value
+	err     error
+}
+
+// fakeDriver is a database/sql driver answering every query of a database
+// with its fakeResult, for testing how rows are read without Postgres.
+type fakeDriver struct {
+	mu      sync.Mutex
+	results map[string]fakeResult
+}
+
+var fakeDrv = &fakeDriver{results: make(map[string]fakeResult)}
+
+func init() {
+	sql.Register("fake", fakeDrv)
+}
+
+// openFakeDB opens a database answering every query with res.
+func openFakeDB(t testing.TB, res fakeResult) *sql.DB {
+	t.Helper()
+	fakeDrv.mu.Lock()
+	name := strconv.Itoa(len(fakeDrv.results))
+	fakeDrv.results[name] = res
+	fakeDrv.mu.Unlock()
+	db, err := sql.Open("fake", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newFakeRepository returns a repository over a database answering every
+// query with res.
+func newFakeRepository(t testing.TB, res fakeResult) *Repository {
+	t.Helper()
+	return NewRepository(openFakeDB(t, res), "", TableNames{
+		Provinces:    "tb_provinces",
+		Cities:       "tb_cities",
+		ProvinceTags: "tb_province_tags",
+	})
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res, ok := d.results[name]
+	if !ok {
+		return nil, errors.New("fake: unknown database " + name)
+	}
+	return fakeConn{res}, nil
+}
+
+type fakeConn struct {
+	res fakeResult
+}
+
+func (c fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return &fakeRows{res: c.res}, nil
+}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("fake: prepared statements are not supported")
+}
+
+func (fakeConn) Close() error { return nil }
+
+func (fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("fake: transactions are not supported")
+}
+
+type fakeRows struct {
+	res  fakeResult
+	next int
+}
+
+func (r *fakeRows) Columns() []string { return r.res.columns }
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next == len(r.res.rows) {
+		if r.res.err != nil {
+			return r.res.err
+		}
+		return io.EOF
+	}
+	copy(dest, r.res.rows[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// ErrReadOnly is returned for writes while the service runs on a snapshot.
+var ErrReadOnly = errors.New("service is temporarily read-only")
+
+// FallbackRepository serves reads from a snapshot while the database is
+// unreachable and switches back to the database once it can be reached.
+// Writes are rejected with ErrReadOnly while degraded.
+type FallbackRepository struct {
+	*Repository
+
+	snapshot *MemoryRepository
+	interval time.Duration
+	degraded int32
+}
+
+// NewFallbackRepository creates a repository that starts out degraded,
+// serving reads from snapshot. Reconnect tries the database every interval.
+func NewFallbackRepository(live *Repository, snapshot *MemoryRepository, interval time.Duration) *FallbackRepository {
+	return &FallbackRepository{Repository: live, snapshot: snapshot, interval: interval, degraded: 1}
+}
+
+// Degraded reports whether reads are served from the snapshot.
+func (r *FallbackRepository) Degraded() bool {
+	return atomic.LoadInt32(&r.degraded) == 1
+}
+
+// Reconnect pings db every interval until it answers, then switches reads
+// back to the database. It returns early when ctx is done.
+func (r *FallbackRepository) Reconnect(ctx context.Context, db *sql.DB) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := db.PingContext(ctx); err != nil {
+			log.Printf("database still unreachable, serving snapshot: %v", err)
+			continue
+		}
+		// The features are looked up before the switch, which publishes
+		// them to the readers.
+		if err := r.Repository.detectFeatures(ctx); err != nil {
+			log.Printf("failed to look up the database features, serving snapshot: %v", err)
+			continue
+		}
+		atomic.StoreInt32(&r.degraded, 0)
+		log.Printf("database reachable again, switched to live reads")
+		return
+	}
+}
+
+// errReadOnly is ErrReadOnly, asking clients to retry once the next
+// reconnect attempt may have succeeded.
+func (r *FallbackRepository) errReadOnly() error {
+	return withRetryAfter(ErrReadOnly, r.interval)
+}
+
+// fuzzySearch reports whether fuzzy searches use pg_trgm, which the
+// snapshot does not.
+func (r *FallbackRepository) fuzzySearch() bool {
+	return !r.Degraded() && r.Repository.fuzzySearch()
+}
+
+// reader returns the repository that currently serves reads.
+func (r *FallbackRepository) reader() ProvinceReader {
+	if r.Degraded() {
+		return r.snapshot
+	}
+	return r.Repository
+}
+
+func (r *FallbackRepository) GetProvinces(ctx context.Context, f ProvinceFilter) ([]Province, error) {
+	return r.reader().GetProvinces(ctx, f)
+}
+
+func (r *FallbackRepository) CountProvinces(ctx context.Context, f ProvinceFilter) (int, error) {
+	return r.reader().CountProvinces(ctx, f)
+}
+
+func (r *FallbackRepository) GetProvincesByIDs(ctx context.Context, ids []int) ([]Province, error) {
+	return r.reader().GetProvincesByIDs(ctx, ids)
+}
+
+func (r *FallbackRepository) GetProvincesByCodes(ctx context.Context, codes []string) ([]Province, error) {
+	return r.reader().GetProvincesByCodes(ctx, codes)
+}
+
+func (r *FallbackRepository) GetProvinceByID(ctx context.Context, provinceID int) (Province, error) {
+	return r.reader().GetProvinceByID(ctx, provinceID)
+}
+
+func (r *FallbackRepository) GetProvincesWithin(ctx context.Context, bbox BBox) ([]Province, error) {
+	return r.reader().GetProvincesWithin(ctx, bbox)
+}
+
+func (r *FallbackRepository) GetCentroids(ctx context.Context) ([]Centroid, error) {
+	return r.reader().GetCentroids(ctx)
+}
+
+func (r *FallbackRepository) GetNearestProvinces(ctx context.Context, lng, lat float64, limit int) ([]NearbyProvince, error) {
+	return r.reader().GetNearestProvinces(ctx, lng, lat, limit)
+}
+
+func (r *FallbackRepository) GetProvincesByRegion(ctx context.Context) ([]Province, error) {
+	return r.reader().GetProvincesByRegion(ctx)
+}
+
+func (r *FallbackRepository) GetManifest(ctx context.Context) ([]ManifestEntry, error) {
+	return r.reader().GetManifest(ctx)
+}
+
+func (r *FallbackRepository) FindProvince(ctx context.Context, name, region string) (Province, error) {
+	return r.reader().FindProvince(ctx, name, region)
+}
+
+func (r *FallbackRepository) DataVersion(ctx context.Context) (string, error) {
+	return r.reader().DataVersion(ctx)
+}
+
+func (r *FallbackRepository) ProvinceExists(ctx context.Context, provinceID int) (bool, error) {
+	return r.reader().ProvinceExists(ctx, provinceID)
+}
+
+func (r *FallbackRepository) GetProvinceByCode(ctx context.Context, code string) (Province, error) {
+	return r.reader().GetProvinceByCode(ctx, code)
+}
+
+func (r *FallbackRepository) Search(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	return r.reader().Search(ctx, query, limit)
+}
+
+func (r *FallbackRepository) GetCities(ctx context.Context, provinceID int, sort Sort, page Page, inactive bool) ([]City, error) {
+	return r.reader().GetCities(ctx, provinceID, sort, page, inactive)
+}
+
+func (r *FallbackRepository) GetCityNames(ctx context.Context, provinceID int, sort Sort, inactive bool) ([]string, error) {
+	return r.reader().GetCityNames(ctx, provinceID, sort, inactive)
+}
+
+func (r *FallbackRepository) GetCityIDs(ctx context.Context, provinceID int, inactive bool) ([]int, error) {
+	return r.reader().GetCityIDs(ctx, provinceID, inactive)
+}
+
+func (r *FallbackRepository) GetAllCities(ctx context.Context, page Page, withProvince, inactive bool) ([]CityListing, error) {
+	return r.reader().GetAllCities(ctx, page, withProvince, inactive)
+}
+
+func (r *FallbackRepository) CountAllCities(ctx context.Context, inactive bool) (int, error) {
+	return r.reader().CountAllCities(ctx, inactive)
+}
+
+func (r *FallbackRepository) StreamCities(ctx context.Context, provinceID int, inactive bool, fn func(City) error) error {
+	return r.reader().StreamCities(ctx, provinceID, inactive, fn)
+}
+
+func (r *FallbackRepository) CountCities(ctx context.Context, provinceID int, inactive bool) (int, error) {
+	return r.reader().CountCities(ctx, provinceID, inactive)
+}
+
+func (r *FallbackRepository) GetCitiesByProvinceIDs(ctx context.Context, provinceIDs []int, inactive bool) (map[int][]City, error) {
+	return r.reader().GetCitiesByProvinceIDs(ctx, provinceIDs, inactive)
+}
+
+func (r *FallbackRepository) GetTags(ctx context.Context, provinceIDs ...int) (map[int][]string, error) {
+	return r.reader().GetTags(ctx, provinceIDs...)
+}
+
+func (r *FallbackRepository) CreateProvince(ctx context.Context, p Province) error {
+	if r.Degraded() {
+		return r.errReadOnly()
+	}
+	return r.Repository.CreateProvince(ctx, p)
+}
+
+func (r *FallbackRepository) ImportProvinces(ctx context.Context, provinces []Province) (map[int]bool, error) {
+	if r.Degraded() {
+		return nil, r.errReadOnly()
+	}
+	return r.Repository.ImportProvinces(ctx, provinces)
+}
+
+func (r *FallbackRepository) AddTag(ctx context.Context, provinceID int, tag string) error {
+	if r.Degraded() {
+		return r.errReadOnly()
+	}
+	return r.Repository.AddTag(ctx, provinceID, tag)
+}
+
+func (r *FallbackRepository) RemoveTag(ctx context.Context, provinceID int, tag string) error {
+	if r.Degraded() {
+		return r.errReadOnly()
+	}
+	return r.Repository.RemoveTag(ctx, provinceID, tag)
+}
+
+func (r *FallbackRepository) DeleteProvinces(ctx context.Context, ids []int) (*BulkDeleteResult, error) {
+	if r.Degraded() {
+		return nil, r.errReadOnly()
+	}
+	return r.Repository.DeleteProvinces(ctx, ids)
+}
+
+func (r *FallbackRepository) UpdateCity(ctx context.Context, cityID int, fields CityUpdate) (City, error) {
+	if r.Degraded() {
+		return City{}, r.errReadOnly()
+	}
+	return r.Repository.UpdateCity(ctx, cityID, fields)
+}
+
+func (r *FallbackRepository) UpdateProvince(ctx context.Context, provinceID int, fields ProvinceUpdate) (Province, error) {
+	if r.Degraded() {
+		return Province{}, r.errReadOnly()
+	}
+	return r.Repository.UpdateProvince(ctx, provinceID, fields)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Features lists the optional capabilities of the deployment, as set up
+// from the environment at startup, so that clients can adapt to them
+// rather than probe the endpoints.
+type Features struct {
+	// Storage is the STORAGE the data is served from, postgres or memory.
+	Storage string `json:"storage"`
+
+	// Cache is set when reads are cached (CACHE_TTL).
+	Cache bool `json:"cache"`
+
+	// FuzzySearch is set when fuzzy=true matches similar names; without
+	// pg_trgm it falls back to substring matches.
+	FuzzySearch bool `json:"fuzzy_search"`
+
+	// Geo is set when the province boundaries are available, which the
+	// within, nearest and centroids endpoints need; the snapshot has none.
+	Geo bool `json:"geo"`
+
+	// Compression is set when responses may be compressed
+	// (ENABLE_COMPRESSION).
+	Compression bool `json:"compression"`
+
+	// GRPC is set when the gRPC service is served (GRPC_PORT).
+	GRPC bool `json:"grpc"`
+
+	// StrictQuery is set when unknown query parameters are rejected
+	// (STRICT_QUERY).
+	StrictQuery bool `json:"strict_query"`
+
+	// OptionalCities is set when a province is served without its cities
+	// if they are unavailable (OPTIONAL_CITIES).
+	OptionalCities bool `json:"optional_cities"`
+}
+
+// fuzzySearch reports whether fuzzy searches use pg_trgm.
+func (r *Repository) fuzzySearch() bool {
+	return r.similarity > 0
+}
+
+// serveFeatures answers with the features of the deployment. fuzzy, when
+// set, tells whether fuzzy searches use pg_trgm, which may change once a
+// database unreachable at startup is reached.
+func serveFeatures(f Features, fuzzy func() bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if fuzzy != nil {
+			f.FuzzySearch = fuzzy()
+		}
+		return c.JSON(http.StatusOK, f)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+// geoJSONContentType is the media type of GeoJSON documents (RFC 7946).
+const geoJSONContentType = "application/geo+json"
+
+// Centroid is the center point of a province boundary.
+type Centroid struct {
+	ID   int
+	Code string
+	Name string
+	Lng  float64
+	Lat  float64
+}
+
+// NearbyProvince is a province found near a point, with the distance from
+// the point to its centroid.
+type NearbyProvince struct {
+	ID          int     `json:"id"`
+	Code        string  `json:"code"`
+	Name        string  `json:"name"`
+	NameEnglish string  `json:"name_english"`
+	Region      string  `json:"region,omitempty"`
+	DistanceKm  float64 `json:"distance_km"`
+}
+
+// FeatureCollection is a GeoJSON feature collection.
+type FeatureCollection struct {
+	Type     string    `json:"type"`
+	Features []Feature `json:"features"`
+}
+
+// Feature is a GeoJSON feature with a point geometry.
+type Feature struct {
+	Type       string         `json:"type"`
+	Geometry   Point          `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+// Point is a GeoJSON point; coordinates are longitude then latitude.
+type Point struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// centroidFeatures returns centroids as a feature collection with the id,
+// code and name of each province as properties.
+func centroidFeatures(centroids []Centroid) FeatureCollection {
+	features := make([]Feature, len(centroids))
+	for i, c := range centroids {
+		features[i] = Feature{
+			Type:     "Feature",
+			Geometry: Point{Type: "Point", Coordinates: [2]float64{c.Lng, c.Lat}},
+			Properties: map[string]any{
+				"id":   c.ID,
+				"code": c.Code,
+				"name": c.Name,
+			},
+		}
+	}
+	return FeatureCollection{Type: "FeatureCollection", Features: features}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The gRPC ProvinceService of proto/province.proto serves the same reads as
+// the REST API. Like the Protocol Buffers responses, its messages are
+// encoded by hand, by wireCodec, rather than with generated types.
+
+// provincesRequest is the GetProvincesRequest message; it has no fields.
+type provincesRequest struct{}
+
+// provinceRequest is the GetProvinceRequest message.
+type provinceRequest struct {
+	ID int
+}
+
+// citiesRequest is the GetCitiesRequest message.
+type citiesRequest struct {
+	ProvinceID int
+}
+
+// provinceList is the ProvinceList message.
+type provinceList struct {
+	Provinces []Province
+}
+
+// cityList is the CityList message.
+type cityList struct {
+	Cities []City
+}
+
+// provinceServiceServer is the server side of the ProvinceService.
+type provinceServiceServer interface {
+	GetProvinces(ctx context.Context, req *provincesRequest) (*provinceList, error)
+	GetProvince(ctx context.Context, req *provinceRequest) (*Province, error)
+	GetCities(ctx context.Context, req *citiesRequest) (*cityList, error)
+}
+
+// grpcServer implements the ProvinceService over the service.
+type grpcServer struct {
+	service *Service
+}
+
+// newGRPCServer creates a gRPC server with the ProvinceService registered.
+func newGRPCServer(s *Service) *grpc.Server {
+	srv := grpc.NewServer(grpc.ForceServerCodec(wireCodec{}))
+	srv.RegisterService(&provinceServiceDesc, &grpcServer{service: s})
+	return srv
+}
+
+func (s *grpcServer) GetProvinces(ctx context.Context, req *provincesRequest) (*provinceList, error) {
+	provinces, _, err := s.service.GetProvinces(ctx, ProvinceFilter{}, Include{})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &provinceList{Provinces: provinces}, nil
+}
+
+func (s *grpcServer) GetProvince(ctx context.Context, req *provinceRequest) (*Province, error) {
+	p, err := s.service.GetProvinceByID(ctx, req.ID, Include{Cities: true}, Sort{Field: "name"})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return p, nil
+}
+
+func (s *grpcServer) GetCities(ctx context.Context, req *citiesRequest) (*cityList, error) {
+	cities, _, err := s.service.GetCityPage(ctx, req.ProvinceID, Sort{Field: "name"}, Page{}, false)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &cityList{Cities: cities}, nil
+}
+
+// grpcError converts err to a gRPC status, with the code matching the HTTP
+// status the REST API answers with.
+func grpcError(err error) error {
+	var verrs ValidationErrors
+	if errors.As(err, &verrs) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	ec, ok := lookupErrorCode(err)
+	if !ok {
+		return status.Error(codes.Internal, "internal server error")
+	}
+	switch ec.status {
+	case http.StatusBadRequest:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case http.StatusNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case http.StatusConflict:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case http.StatusServiceUnavailable:
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		return status.Error(codes.Unknown, err.Error())
+	}
+}
+
+// unaryHandler adapts a method of the server to a grpc.MethodDesc handler.
+func unaryHandler[Req any, Res any](method string, call func(provinceServiceServer, context.Context, *Req) (*Res, error)) func(any, context.Context, func(any) error, grpc.UnaryServerInterceptor) (any, error) {
+	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+		req := new(Req)
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return call(srv.(provinceServiceServer), ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/province.v1.ProvinceService/" + method}
+		return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+			return call(srv.(provinceServiceServer), ctx, req.(*Req))
+		})
+	}
+}
+
+var provinceServiceDesc = grpc.ServiceDesc{
+	ServiceName: "province.v1.ProvinceService",
+	HandlerType: (*provinceServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "GetProvinces", Handler: unaryHandler("GetProvinces", provinceServiceServer.GetProvinces)},
+		{MethodName: "GetProvince", Handler: unaryHandler("GetProvince", provinceServiceServer.GetProvince)},
+		{MethodName: "GetCities", Handler: unaryHandler("GetCities", provinceServiceServer.GetCities)},
+	},
+	Metadata: "proto/province.proto",
+}
+
+// wireCodec encodes the messages of the ProvinceService in the Protocol
+// Buffers wire format.
+type wireCodec struct{}
+
+func (wireCodec) Name() string { return "proto" }
+
+func (wireCodec) Marshal(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case *Province:
+		return appendProvince(nil, *v), nil
+	case *provinceList:
+		return appendProvinceList(nil, v.Provinces), nil
+	case *cityList:
+		var b []byte
+		for _, c := range v.Cities {
+			b = protowire.AppendTag(b, 1, protowire.BytesType)
+			b = protowire.AppendBytes(b, appendCity(nil, c))
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("wire codec: cannot marshal %T", v)
+}
+
+func (wireCodec) Unmarshal(data []byte, v any) error {
+	switch v := v.(type) {
+	case *provincesRequest:
+		return consumeFields(data, nil)
+	case *provinceRequest:
+		return consumeFields(data, map[protowire.Number]*int{1: &v.ID})
+	case *citiesRequest:
+		return consumeFields(data, map[protowire.Number]*int{1: &v.ProvinceID})
+	}
+	return fmt.Errorf("wire codec: cannot unmarshal %T", v)
+}
+
+// consumeFields reads the int32 fields of a message into ints, skipping
+// unknown fields.
+func consumeFields(b []byte, ints map[protowire.Number]*int) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if dst, ok := ints[num]; ok && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			*dst = int(int32(v))
+			b = b[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
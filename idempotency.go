@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ErrIdempotencyKeyInUse is returned when a request arrives while another
+// request with the same Idempotency-Key is still being processed.
+var ErrIdempotencyKeyInUse = errors.New("a request with this Idempotency-Key is still in progress")
+
+// ErrIdempotencyKeyReused is returned when an Idempotency-Key is sent again
+// with a different request.
+var ErrIdempotencyKeyReused = errors.New("Idempotency-Key was already used for a different request")
+
+// storedResponse is a response recorded for an idempotency key.
+type storedResponse struct {
+	fingerprint [sha256.Size]byte
+	done        bool
+	status      int
+	contentType string
+	location    string
+	body        []byte
+	expiresAt   time.Time
+}
+
+// IdempotencyStore remembers the responses of requests sent with an
+// Idempotency-Key header so that retries get the original response back
+// instead of repeating the operation.
+type IdempotencyStore struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	responses map[string]*storedResponse
+	lastSweep time.Time
+}
+
+// NewIdempotencyStore creates a store whose keys expire after ttl.
+func NewIdempotencyStore(ttl time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{
+		ttl:       ttl,
+		responses: make(map[string]*storedResponse),
+		lastSweep: time.Now(),
+	}
+}
+
+// Middleware replays the stored response for a known Idempotency-Key.
+// Requests without the header are passed through untouched.
+func (s *IdempotencyStore) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get("Idempotency-Key")
+			if key == "" {
+				return next(c)
+			}
+			body, err := io.ReadAll(c.Request().Body)
+			if err != nil {
+				return err
+			}
+			c.Request().Body = io.NopCloser(bytes.NewReader(body))
+			fingerprint := sha256.Sum256(append([]byte(c.Request().Method+" "+c.Path()+"\n"), body...))
+
+			stored, err := s.begin(key, fingerprint)
+			if err != nil {
+				return err
+			}
+			if stored != nil {
+				c.Response().Header().Set("Idempotent-Replayed", "true")
+				if stored.location != "" {
+					c.Response().Header().Set(echo.HeaderLocation, stored.location)
+				}
+				if len(stored.body) == 0 {
+					return c.NoContent(stored.status)
+				}
+				return c.Blob(stored.status, stored.contentType, stored.body)
+			}
+
+			rec := &responseRecorder{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = rec
+			err = next(c)
+			if err != nil {
+				c.Error(err)
+			}
+			s.finish(key, c.Response().Status, c.Response().Header(), rec.body.Bytes())
+			return nil
+		}
+	}
+}
+
+// begin reserves key for a new request, or returns the stored response
+// when the key has already been processed.
+func (s *IdempotencyStore) begin(key string, fingerprint [sha256.Size]byte) (*storedResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+	if r, ok := s.responses[key]; ok && now.Before(r.expiresAt) {
+		switch {
+		case r.fingerprint != fingerprint:
+			return nil, ErrIdempotencyKeyReused
+		case !r.done:
+			return nil, ErrIdempotencyKeyInUse
+		default:
+			return r, nil
+		}
+	}
+	s.responses[key] = &storedResponse{fingerprint: fingerprint, expiresAt: now.Add(s.ttl)}
+	return nil, nil
+}
+
+// finish records the response for key. Server errors are not stored so
+// that the client can retry them.
+func (s *IdempotencyStore) finish(key string, status int, header http.Header, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.responses[key]
+	if !ok {
+		return
+	}
+	if status >= http.StatusInternalServerError {
+		delete(s.responses, key)
+		return
+	}
+	r.done = true
+	r.status = status
+	r.contentType = header.Get(echo.HeaderContentType)
+	r.location = header.Get(echo.HeaderLocation)
+	r.body = body
+}
+
+// sweep drops expired keys, at most once per minute.
+func (s *IdempotencyStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, r := range s.responses {
+		if !now.Before(r.expiresAt) {
+			delete(s.responses, key)
+		}
+	}
+}
+
+// responseRecorder copies everything written to the response.
+type responseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
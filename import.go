@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ndjsonContentType is the media type of newline-delimited JSON.
+const ndjsonContentType = "application/x-ndjson"
+
+// maxImportLine is the longest line of an import body.
+const maxImportLine = 1 << 20
+
+// ImportProgress reports how far an import got.
+type ImportProgress struct {
+	Processed int `json:"processed"`
+	Inserted  int `json:"inserted"`
+	Errors    int `json:"errors"`
+
+	// RowErrors lists the rejected rows; it is sent with the final progress
+	// only.
+	RowErrors []ImportRowError `json:"row_errors,omitempty"`
+
+	// Done marks the final progress of an import.
+	Done bool `json:"done,omitempty"`
+
+	// Aborted tells why the import stopped before the end of the body.
+	Aborted string `json:"aborted,omitempty"`
+}
+
+// ImportRowError tells why a row of an import was rejected.
+type ImportRowError struct {
+	Line    int              `json:"line"`
+	Message string           `json:"message"`
+	Fields  ValidationErrors `json:"fields,omitempty"`
+}
+
+// reject records the rejection of the row at line.
+func (p *ImportProgress) reject(line int, message string, fields ValidationErrors) {
+	p.Errors++
+	p.RowErrors = append(p.RowErrors, ImportRowError{Line: line, Message: message, Fields: fields})
+}
+
+// sorted returns the progress with the row errors in line order, as those
+// found on insert come after those found on reading.
+func (p ImportProgress) sorted() ImportProgress {
+	sort.SliceStable(p.RowErrors, func(i, j int) bool { return p.RowErrors[i].Line < p.RowErrors[j].Line })
+	return p
+}
+
+// progress returns the progress without the row errors.
+func (p ImportProgress) progress() ImportProgress {
+	p.RowErrors = nil
+	return p
+}
+
+// ImportProvinces inserts the provinces read from r, one JSON object per
+// line, in batches of ImportBatchSize, each in a transaction, pausing
+// ImportInterval between them. Rows that are malformed or whose id or code
+// is in use are rejected without failing the import, until more than
+// ImportMaxErrors are. report is called after each batch.
+func (s *Service) ImportProvinces(ctx context.Context, r io.Reader, report func(ImportProgress) error) (ImportProgress, error) {
+	var progress ImportProgress
+	batch := make([]Province, 0, s.cfg.ImportBatchSize)
+	// lines maps the ids of the batch to the line they were read from.
+	lines := make(map[int]int)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		inserted, err := s.repo.ImportProvinces(ctx, batch)
+		if err != nil {
+			return err
+		}
+		for _, p := range batch {
+			if inserted[p.ID] {
+				progress.Inserted++
+			} else {
+				progress.reject(lines[p.ID], "id or code is already in use", nil)
+			}
+		}
+		batch, lines = batch[:0], make(map[int]int)
+		return report(progress.progress())
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxImportLine)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		progress.Processed++
+		p, verrs, err := importRow(text)
+		switch first, repeated := lines[p.ID]; {
+		case err != nil:
+			progress.reject(line, "invalid JSON: "+err.Error(), nil)
+		case len(verrs) > 0:
+			progress.reject(line, "invalid province", verrs)
+		case repeated:
+			progress.reject(line, fmt.Sprintf("id is already used on line %d", first), nil)
+		default:
+			batch = append(batch, p)
+			lines[p.ID] = line
+		}
+		full := len(batch) >= s.cfg.ImportBatchSize
+		if full {
+			if err := flush(); err != nil {
+				return progress, err
+			}
+		}
+		if progress.Errors > s.cfg.ImportMaxErrors {
+			progress.Aborted = fmt.Sprintf("more than %d rows were rejected", s.cfg.ImportMaxErrors)
+			return progress.sorted(), nil
+		}
+		if full && s.cfg.ImportInterval > 0 {
+			select {
+			case <-ctx.Done():
+				return progress, ctx.Err()
+			case <-time.After(s.cfg.ImportInterval):
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		progress.Aborted = "reading the body failed: " + err.Error()
+		return progress.sorted(), nil
+	}
+	if err := flush(); err != nil {
+		return progress, err
+	}
+	progress.Done = true
+	return progress.sorted(), nil
+}
+
+// importRow decodes the province of an import line and checks its fields.
+func importRow(text []byte) (Province, ValidationErrors, error) {
+	var in ProvinceInput
+	if err := json.Unmarshal(text, &in); err != nil {
+		return Province{}, nil, err
+	}
+	p := normalizeProvince(in.Province())
+	return p, validateProvince(p), nil
+}
+
+// Import inserts the provinces of an NDJSON body and streams the progress
+// as NDJSON, one line per batch. The final line carries the rejected rows.
+// Neither SERVER_READ_TIMEOUT nor SERVER_WRITE_TIMEOUT bound the import.
+func (h *handler) Import(c echo.Context) error {
+	ctx := c.Request().Context()
+	res := c.Response()
+	// The body is still being read when the progress is written, which the
+	// HTTP/1 server only allows in full duplex; HTTP/2 always allows it.
+	if err := http.NewResponseController(res.Writer).EnableFullDuplex(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	enc := json.NewEncoder(res)
+	report := func(p ImportProgress) error {
+		if !res.Committed {
+			res.Header().Set(echo.HeaderContentType, ndjsonContentType)
+			res.WriteHeader(http.StatusOK)
+		}
+		if err := enc.Encode(p); err != nil {
+			return err
+		}
+		res.Flush()
+		return nil
+	}
+	progress, err := h.service.ImportProvinces(ctx, c.Request().Body, report)
+	if err != nil {
+		if !res.Committed {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		// The response is already committed, report the error in-band.
+		c.Logger().Error(err)
+		progress.Aborted = "something went wrong"
+	}
+	return report(progress)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/labstack/echo/v4"
+)
+
+// integritySampleSize is the number of offending ids an integrity check
+// reports.
+const integritySampleSize = 20
+
+// IntegrityReport lists the rows breaking the integrity of the dataset,
+// which the read API would otherwise hide: cities of a missing province are
+// never listed, and a duplicate code resolves to a single province.
+type IntegrityReport struct {
+	OrphanedCities IntegrityCheck `json:"orphaned_cities"`
+	DuplicateCodes IntegrityCheck `json:"duplicate_codes"`
+}
+
+// IntegrityCheck counts the rows failing a check, with a sample of their
+// ids.
+type IntegrityCheck struct {
+	Count     int   `json:"count"`
+	SampleIDs []int `json:"sample_ids"`
+}
+
+// CheckIntegrity finds the cities whose province does not exist and the
+// provinces sharing their code with another.
+func (r *Repository) CheckIntegrity(ctx context.Context) (*IntegrityReport, error) {
+	orphans, err := r.integrityCheck(ctx, sq.Select("count(*) OVER ()", "c.id").
+		From(r.tables.cities+" c").
+		LeftJoin(r.tables.provinces+" p ON p.id = c.province_id").
+		Where("p.id IS NULL").
+		OrderBy("c.id ASC"))
+	if err != nil {
+		return nil, err
+	}
+	duplicates, err := r.integrityCheck(ctx, sq.Select("count(*) OVER ()", "id").
+		FromSelect(sq.Select("id", "count(*) OVER (PARTITION BY code) AS n").
+			From(r.tables.provinces).
+			Where("code IS NOT NULL"), "d").
+		Where("n > 1").
+		OrderBy("id ASC"))
+	if err != nil {
+		return nil, err
+	}
+	return &IntegrityReport{OrphanedCities: orphans, DuplicateCodes: duplicates}, nil
+}
+
+// integrityCheck runs a query selecting the total count and the id of the
+// offending rows, keeping the first ids as the sample.
+func (r *Repository) integrityCheck(ctx context.Context, b sq.SelectBuilder) (IntegrityCheck, error) {
+	q, args, err := b.Limit(integritySampleSize).PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return IntegrityCheck{}, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return IntegrityCheck{}, err
+	}
+	defer rows.Close()
+
+	check := IntegrityCheck{SampleIDs: make([]int, 0)}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&check.Count, &id); err != nil {
+			return IntegrityCheck{}, err
+		}
+		check.SampleIDs = append(check.SampleIDs, id)
+	}
+	return check, rows.Err()
+}
+
+// CheckIntegrity checks the integrity of the database.
+func (s *Service) CheckIntegrity(ctx context.Context) (*IntegrityReport, error) {
+	c, ok := findRepository[interface {
+		CheckIntegrity(ctx context.Context) (*IntegrityReport, error)
+	}](s.repo)
+	if !ok {
+		return nil, errors.New("integrity checks need the database")
+	}
+	return c.CheckIntegrity(ctx)
+}
+
+// Integrity reports the orphaned cities and the duplicate province codes.
+func (h *handler) Integrity(c echo.Context) error {
+	report, err := h.service.CheckIntegrity(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, report)
+}
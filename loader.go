@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxLoaderBatch caps the number of ids looked up by a single query.
+const maxLoaderBatch = 100
+
+// provinceLoader coalesces concurrent lookups of provinces by id: lookups
+// made within wait of the first one of a batch are served by a single
+// query.
+type provinceLoader struct {
+	load func(ctx context.Context, ids []int) ([]Province, error)
+	wait time.Duration
+
+	mu    sync.Mutex
+	batch *loaderBatch
+}
+
+// loaderBatch is a set of ids looked up together. done is closed once
+// provinces or err is set.
+type loaderBatch struct {
+	ids       []int
+	seen      map[int]bool
+	done      chan struct{}
+	provinces map[int]Province
+	err       error
+}
+
+func newProvinceLoader(wait time.Duration, load func(ctx context.Context, ids []int) ([]Province, error)) *provinceLoader {
+	return &provinceLoader{load: load, wait: wait}
+}
+
+// Load returns the province with the given id, or ErrUnknownProvince.
+func (l *provinceLoader) Load(ctx context.Context, id int) (Province, error) {
+	l.mu.Lock()
+	b := l.batch
+	if b == nil {
+		b = &loaderBatch{seen: make(map[int]bool), done: make(chan struct{})}
+		l.batch = b
+		time.AfterFunc(l.wait, func() { l.dispatch(b) })
+	}
+	if !b.seen[id] {
+		b.seen[id] = true
+		b.ids = append(b.ids, id)
+	}
+	full := len(b.ids) >= maxLoaderBatch
+	l.mu.Unlock()
+	if full {
+		go l.dispatch(b)
+	}
+
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		return Province{}, ctx.Err()
+	}
+	if b.err != nil {
+		return Province{}, b.err
+	}
+	p, ok := b.provinces[id]
+	if !ok {
+		return Province{}, ErrUnknownProvince
+	}
+	return p, nil
+}
+
+// dispatch runs the query of a batch, unless it already ran. The query is
+// not bound to any one request as the batch is shared between requests.
+func (l *provinceLoader) dispatch(b *loaderBatch) {
+	l.mu.Lock()
+	if l.batch != b {
+		l.mu.Unlock()
+		return
+	}
+	l.batch = nil
+	l.mu.Unlock()
+
+	provinces, err := l.load(context.Background(), b.ids)
+	if err == nil {
+		b.provinces = make(map[int]Province, len(provinces))
+		for _, p := range provinces {
+			b.provinces[p.ID] = p
+		}
+	}
+	b.err = err
+	close(b.done)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// queryLatency simulates the round trip of a query to the database.
+const queryLatency = 200 * time.Microsecond
+
+// BenchmarkGetProvinceByID compares the number of queries made by
+// concurrent lookups of provinces by id with and without the loader.
+func BenchmarkGetProvinceByID(b *testing.B) {
+	b.Run("direct", func(b *testing.B) {
+		var queries int64
+		load := func(ctx context.Context, id int) (Province, error) {
+			atomic.AddInt64(&queries, 1)
+			time.Sleep(queryLatency)
+			return Province{ID: id}, nil
+		}
+		benchmarkLookups(b, &queries, load)
+	})
+	b.Run("loader", func(b *testing.B) {
+		var queries int64
+		l := newProvinceLoader(time.Millisecond, func(ctx context.Context, ids []int) ([]Province, error) {
+			atomic.AddInt64(&queries, 1)
+			time.Sleep(queryLatency)
+			provinces := make([]Province, len(ids))
+			for i, id := range ids {
+				provinces[i] = Province{ID: id}
+			}
+			return provinces, nil
+		})
+		benchmarkLookups(b, &queries, l.Load)
+	})
+}
+
+// benchmarkLookups runs load concurrently for the ids of the 18 provinces
+// and reports the queries counted per lookup.
+func benchmarkLookups(b *testing.B, queries *int64, load func(ctx context.Context, id int) (Province, error)) {
+	b.SetParallelism(16)
+	b.ResetTimer()
+	var next int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			id := int(atomic.AddInt64(&next, 1)%18) + 1
+			if p, err := load(context.Background(), id); err != nil || p.ID != id {
+				b.Errorf("load(%d) = %d, %v", id, p.ID, err)
+				return
+			}
+		}
+	})
+	b.ReportMetric(float64(atomic.LoadInt64(queries))/float64(b.N), "queries/op")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	elog "github.com/labstack/gommon/log"
+)
+
+// logLevels maps the LOG_LEVEL values to Echo log levels.
+var logLevels = map[string]elog.Lvl{
+	"debug": elog.DEBUG,
+	"info":  elog.INFO,
+	"warn":  elog.WARN,
+	"error": elog.ERROR,
+	"off":   elog.OFF,
+}
+
+// parseLogLevel parses a LOG_LEVEL value.
+func parseLogLevel(level string) (elog.Lvl, error) {
+	lvl, ok := logLevels[strings.ToLower(level)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q, want debug, info, warn, error or off", level)
+	}
+	return lvl, nil
+}
+
+// openLogOutput opens a LOG_OUTPUT destination: stdout, stderr or
+// file:/path. Files are created if needed and appended to.
+func openLogOutput(output string) (io.Writer, error) {
+	switch {
+	case output == "stdout":
+		return os.Stdout, nil
+	case output == "stderr":
+		return os.Stderr, nil
+	case strings.HasPrefix(output, "file:"):
+		f, err := os.OpenFile(strings.TrimPrefix(output, "file:"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		return &failoverWriter{w: f, fallback: os.Stderr}, nil
+	}
+	return nil, fmt.Errorf("unknown log output %q, want stdout, stderr or file:/path", output)
+}
+
+// failoverWriter writes to w until a write fails, then reports the error
+// and writes to fallback instead, so that a full disk does not lose logs.
+type failoverWriter struct {
+	mu       sync.Mutex
+	w        io.Writer
+	fallback io.Writer
+	failed   bool
+}
+
+func (f *failoverWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.failed {
+		n, err := f.w.Write(p)
+		if err == nil {
+			return n, nil
+		}
+		f.failed = true
+		fmt.Fprintf(f.fallback, "log output failed, writing logs to stderr: %v\n", err)
+	}
+	return f.fallback.Write(p)
+}
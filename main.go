@@ -3,22 +3,34 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 
 	sq "github.com/Masterminds/squirrel"
-
-	// import the postgresql driver
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc"
 )
 
 func getEnv(key, fallback string) string {
@@ -28,6 +40,54 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+// getEnvDuration reads a time.Duration from the environment, exiting when
+// the value cannot be parsed.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	failOnError(err, fmt.Sprintf("invalid duration for %s:", key))
+	return d
+}
+
+// getEnvInt reads an integer from the environment, exiting when the value
+// cannot be parsed.
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(value)
+	failOnError(err, fmt.Sprintf("invalid integer for %s:", key))
+	return i
+}
+
+// getEnvFloat reads a float from the environment, exiting when the value
+// cannot be parsed.
+func getEnvFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	failOnError(err, fmt.Sprintf("invalid number for %s:", key))
+	return f
+}
+
+// getEnvBool reads a boolean from the environment, exiting when the value
+// cannot be parsed.
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	failOnError(err, fmt.Sprintf("invalid boolean for %s:", key))
+	return b
+}
+
 func failOnError(err error, msg string) {
 	if err != nil {
 		fmt.Println(msg, err)
@@ -35,38 +95,318 @@ func failOnError(err error, msg string) {
 	}
 }
 
-func main() {
-	db, err := sql.Open("postgres", os.Getenv("DB_URL"))
+// checkReadable checks that the file at path exists and can be read.
+func checkReadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// readMethods are the methods registered for read-only routes. HEAD is
+// served by the GET handler; net/http discards the body.
+var readMethods = []string{http.MethodGet, http.MethodHead}
+
+// openPostgres opens the database repository, falling back to the snapshot
+// while the database is unreachable when SNAPSHOT_FALLBACK is set. The
+// returned database must be closed by the caller.
+func openPostgres(ctx context.Context) (RepositoryIface, *sql.DB) {
+	params := map[string]string{
+		"application_name": getEnv("APP_NAME", "province-api"),
+	}
+	if mode := os.Getenv("DB_SSLMODE"); mode != "" {
+		failOnError(validateSSLMode(mode), "invalid DB_SSLMODE")
+		params["sslmode"] = mode
+	}
+	if cert := os.Getenv("DB_SSLROOTCERT"); cert != "" {
+		_, err := os.Stat(cert)
+		failOnError(err, "invalid DB_SSLROOTCERT")
+		params["sslrootcert"] = cert
+	}
+	dsn, err := buildDSN(os.Getenv("DB_URL"), params)
+	failOnError(err, "invalid DB_URL")
+	db, err := sql.Open("postgres", dsn)
 	failOnError(err, "failed to open database")
-	defer func() {
-		if err := db.Close(); err != nil {
-			failOnError(err, "failed to close database")
-		}
-	}()
 
+	schema := os.Getenv("DB_SCHEMA")
+	if schema != "" {
+		failOnError(validateIdentifier(schema), "invalid DB_SCHEMA")
+	}
+	names := TableNames{
+		Provinces:    getEnv("TABLE_PROVINCES", "tb_provinces"),
+		Cities:       getEnv("TABLE_CITIES", "tb_cities"),
+		ProvinceTags: getEnv("TABLE_PROVINCE_TAGS", "tb_province_tags"),
+	}
+	failOnError(validateIdentifier(names.Provinces), "invalid TABLE_PROVINCES")
+	failOnError(validateIdentifier(names.Cities), "invalid TABLE_CITIES")
+	failOnError(validateIdentifier(names.ProvinceTags), "invalid TABLE_PROVINCE_TAGS")
+
+	live := NewRepository(db, schema, names)
+	live.fuzzyThreshold = getEnvFloat("FUZZY_THRESHOLD", 0.3)
+	var repo RepositoryIface = live
 	if err := db.Ping(); err != nil {
-		failOnError(err, "failed to ping database")
+		if !getEnvBool("SNAPSHOT_FALLBACK", false) {
+			failOnError(err, "failed to ping database")
+		}
+		fmt.Println("database unreachable, serving reads from snapshot:", err)
+		provinces, err := loadSnapshot(os.Getenv("SNAPSHOT_FILE"))
+		failOnError(err, "failed to load snapshot")
+		fallback := NewFallbackRepository(live, NewMemoryRepository(provinces),
+			getEnvDuration("DB_RETRY_INTERVAL", 10*time.Second))
+		go fallback.Reconnect(ctx, db)
+		repo = fallback
+	} else {
+		if !getEnvBool("SKIP_SCHEMA_CHECK", false) {
+			failOnError(checkSchema(ctx, db, schema, names), "unexpected database schema:")
+		}
+		failOnError(live.detectFeatures(ctx), "failed to look up the database features:")
+	}
+	if attempts := getEnvInt("DB_RETRY_ATTEMPTS", 3); attempts > 1 {
+		repo = NewRetryRepository(repo, attempts, getEnvDuration("DB_RETRY_BACKOFF", 50*time.Millisecond))
+	}
+	return repo, db
+}
+
+// startupWatchdog exits the process unless the returned ready func is
+// called within timeout, so that a deploy stuck on a dependency, e.g. an
+// unreachable database, fails instead of hanging. A timeout of 0 disables
+// it.
+func startupWatchdog(timeout time.Duration) (ready func()) {
+	if timeout <= 0 {
+		return func() {}
+	}
+	t := time.AfterFunc(timeout, func() {
+		failOnError(fmt.Errorf("not ready after %s", timeout), "startup timed out:")
+	})
+	return func() { t.Stop() }
+}
+
+func main() {
+	ready := startupWatchdog(getEnvDuration("STARTUP_TIMEOUT", 60*time.Second))
+	logSQL = getEnvBool("LOG_SQL", false)
+	slowQuery = time.Duration(getEnvInt("SLOW_QUERY_MS", 500)) * time.Millisecond
+	maxBatchSize = getEnvInt("MAX_BATCH_SIZE", maxBatchSize)
+	maxOffset = getEnvInt("MAX_OFFSET", maxOffset)
+	switch empty := getEnv("EMPTY_COLLECTIONS", "omit"); empty {
+	case "omit":
+	case "empty":
+		keepEmptyCollections = true
+	default:
+		failOnError(fmt.Errorf("unknown value %q, want omit or empty", empty), "invalid EMPTY_COLLECTIONS:")
+	}
+
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	var repo RepositoryIface
+	var db *sql.DB
+	storage := getEnv("STORAGE", "postgres")
+	switch storage {
+	case "postgres":
+		repo, db = openPostgres(background)
+		defer func() {
+			if err := db.Close(); err != nil {
+				failOnError(err, "failed to close database")
+			}
+		}()
+	case "memory":
+		// Serves the snapshot with no database, e.g. for local development.
+		provinces, err := loadSnapshot(os.Getenv("SNAPSHOT_FILE"))
+		failOnError(err, "failed to load snapshot")
+		repo = NewMemoryRepository(provinces)
+	default:
+		failOnError(fmt.Errorf("unknown storage %q", storage), "invalid STORAGE")
+	}
+	// The cache is kept across restarts in CACHE_FILE, when set.
+	var cached *CachedRepository
+	cachePath := os.Getenv("CACHE_FILE")
+	if ttl := getEnvDuration("CACHE_TTL", 0); ttl > 0 {
+		cached = NewCachedRepository(repo, ttl)
+		repo = cached
+		go cached.Sweep(background)
+		if cachePath != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := cached.LoadFile(ctx, cachePath); err != nil {
+				log.Printf("warning: cache file not loaded: %v", err)
+			}
+			cancel()
+		}
 	}
 
-	repo := NewRepository(db)
-	svc := NewService(repo)
+	svc := NewService(repo, ServiceConfig{
+		CodeWidth:   getEnvInt("CODE_WIDTH", 2),
+		BatchWindow: getEnvDuration("BATCH_WINDOW", 0),
+
+		ImportBatchSize: getEnvInt("IMPORT_BATCH_SIZE", 500),
+		ImportInterval:  getEnvDuration("IMPORT_BATCH_INTERVAL", 50*time.Millisecond),
+		ImportMaxErrors: getEnvInt("IMPORT_MAX_ERRORS", 100),
+
+		OptionalCities: getEnvBool("OPTIONAL_CITIES", false),
+	})
 	h := NewHandler(svc)
 
 	e := echo.New()
-	e.Use(middleware.CORS())
-	e.Use(middleware.Logger())
+	logLevel, err := parseLogLevel(getEnv("LOG_LEVEL", "error"))
+	failOnError(err, "invalid LOG_LEVEL")
+	logOutput, err := openLogOutput(getEnv("LOG_OUTPUT", "stdout"))
+	failOnError(err, "invalid LOG_OUTPUT")
+	e.Logger.SetLevel(logLevel)
+	e.Logger.SetOutput(logOutput)
+	log.SetOutput(logOutput)
+	requests := &inFlight{}
+	e.Use(requests.Middleware())
+	// The read and write timeouts are set per request so that the streaming
+	// routes can run past them.
+	e.Server.ConnContext = saveConn
+	e.Use(connDeadlines(
+		getEnvDuration("SERVER_READ_TIMEOUT", 10*time.Second),
+		getEnvDuration("SERVER_WRITE_TIMEOUT", 30*time.Second),
+		skipStreams))
+	e.Use(jsonCharset())
+	if getEnvBool("ENABLE_CORS", true) {
+		// Off when a gateway in front already sets the CORS headers.
+		e.Use(middleware.CORS())
+	}
+	e.Use(traceContext())
+	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
+		Skipper: skipPaths(getEnv("LOG_SKIP_PATHS", "/healthz,/metrics")),
+		// The default format, with the trace context of the request.
+		Format: strings.Replace(middleware.DefaultLoggerConfig.Format,
+			`"id":"${id}",`, `"id":"${id}","traceparent":"${header:traceparent}",`, 1),
+	}))
+	compression := getEnvBool("ENABLE_COMPRESSION", true)
+	if compression {
+		e.Use(compress(getEnvInt("COMPRESS_MIN_SIZE", 1024)))
+	}
+	if max := getEnvInt("MAX_CONCURRENT_REQUESTS", 100); max > 0 {
+		wait := getEnvDuration("CONCURRENCY_WAIT_TIMEOUT", 100*time.Millisecond)
+		e.Use(concurrencyLimit(max, wait, skipProbes))
+	}
+	if timeout := getEnvDuration("REQUEST_TIMEOUT", 15*time.Second); timeout > 0 {
+		e.Use(requestTimeout(timeout, skipStreams))
+	}
 	e.HTTPErrorHandler = helper
+	e.JSONSerializer = jsonSerializer{pretty: getEnvBool("JSON_PRETTY", false)}
+
+	e.GET("/healthz", h.Healthz)
+	e.GET("/readyz", h.Readyz)
+	e.GET("/metrics", h.Metrics)
+
+	maint := &maintenance{retryAfter: getEnvDuration("MAINTENANCE_RETRY_AFTER", time.Minute)}
+	maint.Set(getEnvBool("MAINTENANCE_MODE", false))
+
+	// Writes need the admin token too, like the admin routes.
+	auth := adminAuth(os.Getenv("ADMIN_TOKEN"))
+	admin := e.Group("/admin", auth)
+	admin.Match([]string{http.MethodGet, http.MethodPut}, "/maintenance", maint.Toggle)
+	admin.POST("/cache/invalidate", h.InvalidateCache)
+	admin.GET("/cache/stats", h.CacheStats)
+	if db != nil {
+		admin.GET("/db/stats", dbStats(db))
+		admin.GET("/integrity", h.Integrity)
+	}
+
+	// With STRICT_QUERY, allow rejects query params a route does not read.
+	strict := getEnvBool("STRICT_QUERY", false)
+	allow := queryAllowlist(strict)
+	provinceParams := []string{"group", "cities", "depth", "sort", "order", "select", "include", "include_inactive"}
 
-	route := e.Group("/api/v1")
-	route.GET("/provinces", h.GetAll)
-	route.GET("/provinces/:id/cities", h.GetByID)
+	route := e.Group("/api/v1", maint.Middleware())
+	etag := versionETag(svc)
+	features := Features{
+		Storage:        storage,
+		Cache:          cached != nil,
+		Geo:            storage == "postgres",
+		Compression:    compression,
+		GRPC:           os.Getenv("GRPC_PORT") != "",
+		StrictQuery:    strict,
+		OptionalCities: svc.cfg.OptionalCities,
+	}
+	var fuzzy func() bool
+	if r, ok := findRepository[interface{ fuzzySearch() bool }](repo); ok {
+		fuzzy = r.fuzzySearch
+	}
+	route.Match(readMethods, "/features", serveFeatures(features, fuzzy), allow())
+	route.Match(readMethods, "/provinces", h.GetAll, allow(
+		"q", "lang", "fuzzy", "has_cities", "codes", "tag", "region", "sort", "order", "limit", "offset", "include", "include_inactive", "select"), etag)
+	route.Match(readMethods, "/provinces/within", h.Within, allow("bbox"))
+	route.Match(readMethods, "/provinces/centroids", h.Centroids, allow(), etag)
+	route.Match(readMethods, "/provinces/manifest", h.Manifest, allow(), etag)
+	route.Match(readMethods, "/provinces/nearest", h.Nearest, allow("lat", "lng", "limit"))
+	route.Match(readMethods, "/provinces/lookup", h.Lookup, allow("name", "region"))
+	route.Match(readMethods, "/provinces/resolve", h.Resolve, allow("value"))
+	route.Match(readMethods, "/provinces/:id", h.GetByID, allow(provinceParams...))
+	route.Match(readMethods, "/provinces/:id/cities", h.GetCities, allow(append(provinceParams, "only")...))
+	route.Match(readMethods, "/provinces/:id/exists", h.Exists, allow())
+	route.Match(readMethods, "/provinces/:id/cities/count", h.CountCities, allow("include_inactive"))
+	route.GET("/provinces/:id/cities/stream", h.StreamCities, allow("include_inactive"))
+	route.GET("/provinces/:id/cities.csv", h.ExportCities, allow("include_inactive"))
+	idempotency := NewIdempotencyStore(getEnvDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour))
+	route.POST("/provinces", h.Create, auth, allow(), idempotency.Middleware())
+	route.DELETE("/provinces", h.DeleteMany, auth, allow("ids"))
+	route.POST("/provinces/import", h.Import, auth, allow())
+	route.POST("/provinces/batch", h.GetBatch, allow("include", "include_inactive"))
+	route.POST("/provinces/by-codes", h.GetByCodes, allow())
+	route.POST("/provinces/query", h.Query, allow("include"))
+	route.POST("/provinces/validate", h.Validate, allow())
+	route.POST("/provinces/diff", h.Diff, allow())
+	route.Match(readMethods, "/provinces/:id/tags", h.GetTags, allow())
+	route.Match(readMethods, "/search", h.Search, allow("q", "limit"))
+	route.Match(readMethods, "/regions", h.GetRegions, allow(), etag)
+	route.Match(readMethods, "/cities", h.GetAllCities, allow("include", "include_inactive", "limit", "offset"), etag)
+	route.POST("/cities/by-provinces", h.GetCitiesByProvinces, allow("include_inactive"))
+	route.PATCH("/provinces/:id", h.UpdateProvince, auth, allow())
+	route.PATCH("/cities/:id", h.UpdateCity, auth, allow())
+	route.POST("/provinces/:id/tags", h.AddTag, auth, allow())
+	route.DELETE("/provinces/:id/tags/:tag", h.RemoveTag, auth, allow())
+
+	e.Server.ReadHeaderTimeout = getEnvDuration("SERVER_READ_HEADER_TIMEOUT", 5*time.Second)
+	e.Server.IdleTimeout = getEnvDuration("SERVER_IDLE_TIMEOUT", 120*time.Second)
+
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	useTLS := certFile != "" || keyFile != ""
+	if useTLS {
+		if certFile == "" || keyFile == "" {
+			failOnError(errors.New("both must be set"), "invalid TLS_CERT_FILE/TLS_KEY_FILE:")
+		}
+		failOnError(checkReadable(certFile), "invalid TLS_CERT_FILE")
+		failOnError(checkReadable(keyFile), "invalid TLS_KEY_FILE")
+	}
 
 	go func() {
-		if err := e.Start(fmt.Sprintf(":%s", getEnv("PORT", "8080"))); err != nil {
+		addr := fmt.Sprintf(":%s", getEnv("PORT", "8080"))
+		var err error
+		if useTLS {
+			err = e.StartTLS(addr, certFile, keyFile)
+		} else {
+			err = e.Start(addr)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			e.Logger.Fatal("Shutting down the server")
 		}
 	}()
 
+	// The server is ready once it listens.
+	go func() {
+		for e.ListenerAddr() == nil && e.TLSListenerAddr() == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+		ready()
+	}()
+
+	var grpcSrv *grpc.Server
+	if port := os.Getenv("GRPC_PORT"); port != "" {
+		lis, err := net.Listen("tcp", ":"+port)
+		failOnError(err, "failed to listen on GRPC_PORT:")
+		grpcSrv = newGRPCServer(svc)
+		go func() {
+			if err := grpcSrv.Serve(lis); err != nil {
+				e.Logger.Fatal("Shutting down the gRPC server", err)
+			}
+		}()
+	}
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
@@ -75,216 +415,4250 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 
-	if err := e.Shutdown(ctx); err != nil {
+	log.Printf("draining %d in-flight request(s)", requests.Count())
+	err = e.Shutdown(ctx)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		e.Logger.Warnf("shutdown timed out with %d request(s) still in flight", requests.Count())
+	case err != nil:
 		e.Logger.Fatal("Failed to shutdown the server", err)
+	default:
+		log.Printf("all in-flight requests completed")
+	}
+	if grpcSrv != nil {
+		stopGRPC(ctx, grpcSrv)
+	}
+	if cached != nil && cachePath != "" {
+		if err := cached.SaveFile(ctx, cachePath); err != nil {
+			log.Printf("warning: cache file not saved: %v", err)
+		}
+	}
+}
+
+// stopGRPC stops srv gracefully, letting the running calls finish, unless
+// ctx is done first, in which case the calls are canceled.
+func stopGRPC(ctx context.Context, srv *grpc.Server) {
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		srv.Stop()
+		log.Printf("gRPC shutdown timed out, canceled the running calls")
+	}
+}
+
+// errorResponse is the body of every error response.
+type errorResponse struct {
+	// Code is the HTTP status and ErrorCode the machine-readable code,
+	// which clients can switch on.
+	Code      int    `json:"code"`
+	ErrorCode string `json:"error_code"`
+	Message   string `json:"message"`
+
+	// Errors lists the invalid fields of a request body.
+	Errors ValidationErrors `json:"errors,omitempty"`
+}
+
+// errorCode is the HTTP status and machine-readable code of a known error.
+type errorCode struct {
+	status int
+	code   string
+}
+
+// errorCodes maps the sentinel errors to their error code.
+var errorCodes = map[error]errorCode{
+	ErrInvalidParamInt:      {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrDuplicateParam:       {http.StatusBadRequest, "DUPLICATE_PARAM"},
+	ErrParamOutOfRange:      {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrMissingParam:         {http.StatusBadRequest, "MISSING_PARAM"},
+	ErrInvalidParamBool:     {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrEmptyIDList:          {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrEmptyCodeList:        {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrNonPositiveID:        {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrBatchTooLarge:        {http.StatusBadRequest, "BATCH_TOO_LARGE"},
+	ErrOffsetTooLarge:       {http.StatusBadRequest, "OFFSET_TOO_LARGE"},
+	ErrConfirmationRequired: {http.StatusPreconditionRequired, "CONFIRMATION_REQUIRED"},
+	ErrInvalidTag:           {http.StatusBadRequest, "INVALID_TAG"},
+	ErrMissingQuery:         {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrInvalidSortField:     {http.StatusBadRequest, "INVALID_SORT"},
+	ErrInvalidSortOrder:     {http.StatusBadRequest, "INVALID_SORT"},
+	ErrInvalidDepth:         {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrInvalidGroup:         {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrInvalidInclude:       {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrInvalidSelect:        {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrUnknownParam:         {http.StatusBadRequest, "UNKNOWN_PARAM"},
+	ErrInvalidOnly:          {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrInvalidCities:        {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrInvalidBBox:          {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrInvalidPoint:         {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrInvalidNearestLimit:  {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrInvalidSearchLimit:   {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrRangeNotSatisfiable:  {http.StatusRequestedRangeNotSatisfiable, "RANGE_NOT_SATISFIABLE"},
+	ErrUnknownProvince:      {http.StatusNotFound, "PROVINCE_NOT_FOUND"},
+	ErrUnknownCity:          {http.StatusNotFound, "CITY_NOT_FOUND"},
+	ErrEmptyUpdate:          {http.StatusBadRequest, "EMPTY_UPDATE"},
+	ErrProvinceExists:       {http.StatusConflict, "PROVINCE_EXISTS"},
+	ErrAmbiguousProvince:    {http.StatusConflict, "AMBIGUOUS_PROVINCE"},
+	ErrMissingName:          {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrMissingValue:         {http.StatusBadRequest, "INVALID_PARAM"},
+	ErrServerBusy:           {http.StatusServiceUnavailable, "SERVER_BUSY"},
+	ErrReadOnly:             {http.StatusServiceUnavailable, "READ_ONLY"},
+	ErrMaintenance:          {http.StatusServiceUnavailable, "MAINTENANCE"},
+	ErrIdempotencyKeyInUse:  {http.StatusConflict, "IDEMPOTENCY_KEY_IN_USE"},
+	ErrIdempotencyKeyReused: {http.StatusUnprocessableEntity, "IDEMPOTENCY_KEY_REUSED"},
+}
+
+// sslModes are the sslmode values lib/pq supports.
+var sslModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+// validateSSLMode checks that mode is supported by lib/pq, which would
+// otherwise only reject it on the first connection.
+func validateSSLMode(mode string) error {
+	for _, m := range sslModes {
+		if mode == m {
+			return nil
+		}
+	}
+	return fmt.Errorf("sslmode %q is not one of %s", mode, strings.Join(sslModes, ", "))
+}
+
+// dsnKeyPattern matches the keys of a key=value connection string.
+var dsnKeyPattern = regexp.MustCompile(`(?:^|\s)(\w+)\s*=`)
+
+// buildDSN merges params into a lib/pq connection string, which may be
+// either a postgres:// URL or a key=value list. Parameters that are already
+// present in dsn are left untouched.
+func buildDSN(dsn string, params map[string]string) (string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", err
+		}
+		q := u.Query()
+		for k, v := range params {
+			if q.Get(k) == "" {
+				q.Set(k, v)
+			}
+		}
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+
+	present := make(map[string]bool)
+	for _, m := range dsnKeyPattern.FindAllStringSubmatch(dsn, -1) {
+		present[m[1]] = true
+	}
+	for k, v := range params {
+		if present[k] {
+			continue
+		}
+		v = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v)
+		dsn = strings.TrimSpace(fmt.Sprintf("%s %s='%s'", dsn, k, v))
+	}
+	return dsn, nil
+}
+
+// lookupErrorCode finds the error code of err or of any error it wraps.
+func lookupErrorCode(err error) (errorCode, bool) {
+	for target, ec := range errorCodes {
+		if errors.Is(err, target) {
+			return ec, true
+		}
 	}
+	return errorCode{}, false
 }
 
 func helper(err error, c echo.Context) {
-	switch err {
-	case ErrInvalidParamInt:
-		c.JSON(http.StatusBadRequest, map[string]interface{}{
-			"code":    http.StatusBadRequest,
-			"message": err.Error(),
+	// The error was already handled, e.g. by compress.
+	if c.Response().Committed {
+		return
+	}
+	var ra *retryAfterError
+	if errors.As(err, &ra) {
+		c.Response().Header().Set("Retry-After", ra.seconds())
+	}
+	if ec, ok := lookupErrorCode(err); ok {
+		c.JSON(ec.status, errorResponse{
+			Code:      ec.status,
+			ErrorCode: ec.code,
+			Message:   err.Error(),
 		})
-
-	case ErrUnknownProvince:
-		c.JSON(http.StatusNotFound, map[string]interface{}{
-			"code":    http.StatusNotFound,
-			"message": err.Error(),
+		return
+	}
+	var verrs ValidationErrors
+	if errors.As(err, &verrs) {
+		c.JSON(http.StatusBadRequest, errorResponse{
+			Code:      http.StatusBadRequest,
+			ErrorCode: "VALIDATION_FAILED",
+			Message:   err.Error(),
+			Errors:    verrs,
 		})
-
-	default:
-		if echoErr, ok := err.(*echo.HTTPError); ok {
-			c.JSON(echoErr.Code, map[string]interface{}{
-				"code":    echoErr.Code,
-				"message": echoErr.Message,
-			})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, map[string]interface{}{
-			"code":    http.StatusInternalServerError,
-			"message": "something went wrong",
+		return
+	}
+	if echoErr, ok := err.(*echo.HTTPError); ok {
+		c.JSON(echoErr.Code, errorResponse{
+			Code:      echoErr.Code,
+			ErrorCode: statusCode(echoErr.Code),
+			Message:   fmt.Sprint(echoErr.Message),
 		})
+		return
 	}
+	c.JSON(http.StatusInternalServerError, errorResponse{
+		Code:      http.StatusInternalServerError,
+		ErrorCode: "INTERNAL",
+		Message:   "something went wrong",
+	})
+}
+
+// statusCode derives an error code from an HTTP status, e.g. NOT_FOUND.
+func statusCode(status int) string {
+	return strings.ToUpper(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+}
+
+// ErrDuplicateParam is an error when a query parameter is given more than once.
+var ErrDuplicateParam = errors.New("param: must not be repeated")
+
+// queryParam returns the value of a query parameter, rejecting requests
+// that repeat it rather than silently picking one of the values.
+func queryParam(c echo.Context, name string) (string, error) {
+	values := c.QueryParams()[name]
+	if len(values) > 1 {
+		return "", fmt.Errorf("%w: '%s'", ErrDuplicateParam, name)
+	}
+	if len(values) == 0 {
+		return "", nil
+	}
+	return values[0], nil
+}
+
+// ErrInvalidInclude is an error when an include param names unsupported
+// related data.
+var ErrInvalidInclude = errors.New("param: 'include' is not valid")
+
+// includeParam reads the include param, which may be repeated or hold a
+// comma-separated list, e.g. include=cities&include=tags or
+// include=cities,tags, into a set of the included names.
+func includeParam(c echo.Context, supported ...string) (map[string]bool, error) {
+	set := make(map[string]bool)
+	for _, v := range c.QueryParams()["include"] {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if !contains(supported, name) {
+				return nil, fmt.Errorf("%w: unknown include '%s', supported: %s",
+					ErrInvalidInclude, name, strings.Join(supported, ", "))
+			}
+			set[name] = true
+		}
+	}
+	return set, nil
 }
 
 // ErrInvalidParamInt is an error when int param not valid.
 var ErrInvalidParamInt = errors.New("param: '<attribute>' cannot be applied because the value is not a number")
 
-// intParam is a validator for integer parameters.
+// ErrParamOutOfRange is an error when an int param does not fit the database
+// integer type.
+var ErrParamOutOfRange = errors.New("param: '<attribute>' cannot be applied because the value is out of range")
+
+// ErrMissingParam is an error when the id path param is empty, e.g. for
+// GET /provinces/.
+var ErrMissingParam = errors.New("param: 'id' is required")
+
+// intParam is a validator for integer parameters. Values must fit a
+// Postgres integer column. Query params are only validated when set, so
+// an empty value is a missing id.
 func intParam(v string) (int, error) {
+	if v == "" {
+		return 0, ErrMissingParam
+	}
 	i, err := strconv.Atoi(v)
 	if err != nil {
 		return 0, ErrInvalidParamInt
 	}
+	if i < math.MinInt32 || i > math.MaxInt32 {
+		return 0, ErrParamOutOfRange
+	}
 	return i, nil
 }
 
-type handler struct {
-	service *Service
-}
+// ErrEmptyIDList is an error when a list of ids is required but none was given.
+var ErrEmptyIDList = errors.New("ids: at least one id is required")
 
-// NewHandler creates a new handler
-func NewHandler(s *Service) *handler {
-	return &handler{s}
-}
+// ErrBatchTooLarge is an error when a request lists more ids or codes than
+// maxBatchSize.
+var ErrBatchTooLarge = errors.New("batch: too many items")
 
-func (h *handler) GetAll(c echo.Context) error {
-	provinces, err := h.service.GetProvinces(c.Request().Context())
-	if err != nil {
-		return err
+// maxBatchSize is the most ids or codes a request may list, which bounds
+// the IN clauses sent to the database; 0 disables the cap.
+var maxBatchSize = 500
+
+// checkBatchSize returns ErrBatchTooLarge, telling the cap, when n items
+// of the given kind exceed maxBatchSize.
+func checkBatchSize(n int, kind string) error {
+	if maxBatchSize > 0 && n > maxBatchSize {
+		return fmt.Errorf("%w: %d %s given, at most %d are allowed per request",
+			ErrBatchTooLarge, n, kind, maxBatchSize)
 	}
-	return c.JSON(http.StatusOK, provinces)
+	return nil
 }
 
-func (h *handler) GetByID(c echo.Context) error {
-	id, err := intParam(c.Param("id"))
-	if err != nil {
-		return err
+// ErrEmptyCodeList is an error when a list of codes is required but none
+// was given.
+var ErrEmptyCodeList = errors.New("codes: at least one code is required")
+
+// validateCodes checks that codes is a non-empty list of province codes and
+// drops blank codes and duplicates, keeping the first of the codes that
+// only differ in case or padding.
+func validateCodes(codes []string) ([]string, error) {
+	unique := make([]string, 0, len(codes))
+	seen := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		code = strings.TrimSpace(code)
+		if code == "" || seen[normalizeCode(code)] {
+			continue
+		}
+		seen[normalizeCode(code)] = true
+		unique = append(unique, code)
 	}
-	p, err := h.service.GetProvinceByID(c.Request().Context(), id)
-	if err != nil {
-		return err
+	if len(unique) == 0 {
+		return nil, ErrEmptyCodeList
 	}
-	return c.JSON(http.StatusOK, p)
+	if err := checkBatchSize(len(unique), "codes"); err != nil {
+		return nil, err
+	}
+	return unique, nil
 }
 
-type Service struct {
-	repo *Repository
+// ErrNonPositiveID is an error when an id in a list is zero or negative.
+var ErrNonPositiveID = errors.New("ids: every id must be a positive integer")
+
+// intListParam is a validator for comma-separated integer parameters.
+func intListParam(v string) ([]int, error) {
+	ids := make([]int, 0)
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		id, err := intParam(s)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return validateIDs(ids)
 }
 
-// NewService creates a new service
-func NewService(r *Repository) *Service {
-	return &Service{r}
+// validateIDs checks that ids is a non-empty list of positive ids and drops
+// duplicates, keeping the first occurrence. The batch size is checked after
+// dropping them, as for codes.
+func validateIDs(ids []int) ([]int, error) {
+	if len(ids) == 0 {
+		return nil, ErrEmptyIDList
+	}
+	unique := make([]int, 0, len(ids))
+	seen := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if id <= 0 {
+			return nil, ErrNonPositiveID
+		}
+		if id > math.MaxInt32 {
+			return nil, ErrParamOutOfRange
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		unique = append(unique, id)
+	}
+	if err := checkBatchSize(len(unique), "ids"); err != nil {
+		return nil, err
+	}
+	return unique, nil
 }
 
-func (s *Service) GetProvinces(ctx context.Context) ([]Province, error) {
-	return s.repo.GetProvinces(ctx)
+// ErrConfirmationRequired is returned when a destructive request is missing
+// the X-Confirm header.
+var ErrConfirmationRequired = errors.New("header: 'X-Confirm: true' is required for this operation")
+
+// ErrInvalidTag is an error when a tag is empty or has unsupported characters.
+var ErrInvalidTag = errors.New("tag: must be 1-50 characters of lowercase letters, digits or '-'")
+
+// tagPattern is the allowed format of a (normalized) tag.
+var tagPattern = regexp.MustCompile(`^[a-z0-9-]{1,50}$`)
+
+// tagParam is a validator for tag values; tags are case-insensitive and
+// normalized to lower case.
+func tagParam(v string) (string, error) {
+	tag := strings.ToLower(strings.TrimSpace(v))
+	if !tagPattern.MatchString(tag) {
+		return "", ErrInvalidTag
+	}
+	return tag, nil
 }
 
-func (s *Service) GetProvinceByID(ctx context.Context, provinceID int) (*Province, error) {
-	p, err := s.repo.GetProvinceByID(ctx, provinceID)
+// ErrMissingName is an error when a lookup has no name.
+var ErrMissingName = errors.New("param: 'name' is required")
+
+// ErrMissingValue is an error when a province is resolved without a value.
+var ErrMissingValue = errors.New("param: 'value' is required")
+
+// ErrMissingQuery is an error when a search is requested without a query.
+var ErrMissingQuery = errors.New("param: 'q' is required")
+
+// maxPageSize is the largest page a client may request.
+const maxPageSize = 100
+
+// pageParams reads the limit and offset query parameters. Without a limit
+// the list is not paginated.
+func pageParams(c echo.Context) (Page, error) {
+	var page Page
+	v, err := queryParam(c, "limit")
 	if err != nil {
-		return nil, err
+		return Page{}, err
 	}
-	cities, err := s.repo.GetCities(ctx, provinceID)
-	if err != nil {
-		return nil, err
+	if v != "" {
+		limit, err := intParam(v)
+		if err != nil {
+			return Page{}, err
+		}
+		page.setLimit(limit)
 	}
-	return assemble(&p, cities), nil
+	if v, err = queryParam(c, "offset"); err != nil {
+		return Page{}, err
+	}
+	if v != "" {
+		offset, err := intParam(v)
+		if err != nil {
+			return Page{}, err
+		}
+		if offset > 0 {
+			page.Offset = offset
+		}
+	}
+	return page, checkOffset(c, page.Offset)
 }
 
-func assemble(province *Province, cities []City) *Province {
-	province.Cities = cities
-	return province
-}
+// ErrOffsetTooLarge is an error when a page starts past maxOffset.
+var ErrOffsetTooLarge = errors.New("param: 'offset' is too large")
 
-// ErrUnknownProvince is returned when a province could not be found.
-var ErrUnknownProvince = errors.New("province could not be found")
+// maxOffset is the largest offset a page may start at, as the database
+// reads and discards every row before it; 0 disables the cap.
+var maxOffset = 10000
 
-// Province represents a province.
-type Province struct {
-	ID          int    `json:"id"`
-	Code        string `json:"code"`
-	Name        string `json:"name"`
-	NameEnglish string `json:"name_english"`
+// checkOffset returns ErrOffsetTooLarge when offset exceeds maxOffset,
+// logging the request as it hints at a client paging through everything.
+func checkOffset(c echo.Context, offset int) error {
+	if maxOffset <= 0 || offset <= maxOffset {
+		return nil
+	}
+	log.Printf("rejected offset %d of %s %s, past MAX_OFFSET %d",
+		offset, c.Request().Method, c.Request().URL.Path, maxOffset)
+	return fmt.Errorf("%w: at most %d is allowed, narrow the filters instead of paging this deep",
+		ErrOffsetTooLarge, maxOffset)
+}
 
-	// Cities represents a list of cities in the province.
-	Cities []City `json:"cities,omitempty"`
+// setLimit sets the limit of the page, clamping it to maxPageSize when it is
+// not positive or too large.
+func (p *Page) setLimit(limit int) {
+	if limit <= 0 || limit > maxPageSize {
+		limit = maxPageSize
+		p.Adjusted = true
+	}
+	p.Limit = limit
 }
 
-// City represents a city.
-type City struct {
-	ID          int    `json:"id"`
-	Name        string `json:"name"`
-	NameEnglish string `json:"name_english"`
+// setPaginationHeaders sets the X-Total-Count header and the RFC 5988 Link
+// header with the first, prev, next and last pages of a paginated list.
+func setPaginationHeaders(c echo.Context, page Page, total int) {
+	link := func(offset int, rel string) string {
+		u := *c.Request().URL
+		q := u.Query()
+		q.Set("limit", strconv.Itoa(page.Limit))
+		q.Set("offset", strconv.Itoa(offset))
+		u.RawQuery = q.Encode()
+		return fmt.Sprintf(`<%s>; rel="%s"`, u.RequestURI(), rel)
+	}
+	last := 0
+	if total > 0 {
+		last = (total - 1) / page.Limit * page.Limit
+	}
+
+	links := []string{link(0, "first")}
+	if page.Offset > 0 {
+		prev := page.Offset - page.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, link(prev, "prev"))
+	}
+	if page.Offset+page.Limit < total {
+		links = append(links, link(page.Offset+page.Limit, "next"))
+	}
+	links = append(links, link(last, "last"))
+
+	c.Response().Header().Set("X-Total-Count", strconv.Itoa(total))
+	c.Response().Header().Set("Link", strings.Join(links, ", "))
 }
 
-type Repository struct {
-	db *sql.DB
+// PageMeta tells a client that the page it got is smaller than requested.
+type PageMeta struct {
+	Limit         int  `json:"limit"`
+	LimitAdjusted bool `json:"limit_adjusted"`
 }
 
-// NewRepository creates a new repository
-func NewRepository(db *sql.DB) *Repository {
-	return &Repository{db: db}
+// AdjustedPage is a page of a list whose requested limit was clamped.
+type AdjustedPage struct {
+	Data any      `json:"data"`
+	Meta PageMeta `json:"meta"`
 }
 
-func (r *Repository) GetProvinces(ctx context.Context) ([]Province, error) {
-	q, args, err := sq.Select("id", "name", "name_english", "code").
-		From("tb_provinces").
-		PlaceholderFormat(sq.Dollar).
-		ToSql()
-	if err != nil {
-		return nil, err
+// pageJSON sends a page of a list. Lists are sent as is, unless the limit
+// was clamped, in which case the clamped limit is sent along with the list
+// so the client is not misled into thinking it got every item it asked for.
+func pageJSON(c echo.Context, page Page, data any) error {
+	if !page.Adjusted {
+		return c.JSON(http.StatusOK, data)
 	}
-	provinces := make([]Province, 0)
-	rows, err := r.db.QueryContext(ctx, q, args...)
+	return c.JSON(http.StatusOK, AdjustedPage{
+		Data: data,
+		Meta: PageMeta{Limit: page.Limit, LimitAdjusted: true},
+	})
+}
+
+// ErrInvalidSortField is an error when a list is sorted by an unsupported field.
+var ErrInvalidSortField = errors.New("param: 'sort' is not a supported sort field")
+
+// ErrInvalidSortOrder is an error when the sort order is neither asc nor desc.
+var ErrInvalidSortOrder = errors.New("param: 'order' must be 'asc' or 'desc'")
+
+// citySortFields are the fields cities can be sorted by.
+var citySortFields = map[string]bool{"id": true, "name": true}
+
+// sortParams reads the sort and order query parameters, checking the sort
+// field against allowed.
+func sortParams(c echo.Context, allowed map[string]bool, defaultField string) (Sort, error) {
+	sort := Sort{Field: defaultField}
+	v, err := queryParam(c, "sort")
 	if err != nil {
-		return nil, err
+		return Sort{}, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		p, err := scanProvince(rows.Scan)
-		if err != nil {
-			return nil, err
+	if v != "" {
+		if !allowed[v] {
+			return Sort{}, ErrInvalidSortField
 		}
-		provinces = append(provinces, p)
+		sort.Field = v
 	}
-	return provinces, nil
+	sort.Desc, err = orderParam(c)
+	return sort, err
 }
 
-func (r *Repository) GetProvinceByID(ctx context.Context, provinceID int) (Province, error) {
-	q, args, err := sq.Select("id", "name", "name_english", "code").
-		From("tb_provinces").
-		Where("id = ?", provinceID).
-		PlaceholderFormat(sq.Dollar).
-		ToSql()
+// orderParam reads the order query parameter, reporting whether it is
+// desc.
+func orderParam(c echo.Context) (bool, error) {
+	order, err := queryParam(c, "order")
 	if err != nil {
-		return Province{}, err
+		return false, err
 	}
-	row := r.db.QueryRowContext(ctx, q, args...)
-	p, err := scanProvince(row.Scan)
-	if errors.Is(err, sql.ErrNoRows) {
-		return Province{}, ErrUnknownProvince
+	switch order {
+	case "", "asc":
+		return false, nil
+	case "desc":
+		return true, nil
+	}
+	return false, ErrInvalidSortOrder
+}
+
+// maxDepth is the deepest level of the hierarchy below a province that can
+// be loaded: 0 is the province alone, 1 adds its cities.
+const maxDepth = 1
+
+// ErrInvalidDepth is an error when the depth param is out of range.
+var ErrInvalidDepth = fmt.Errorf("param: 'depth' must be between 0 and %d", maxDepth)
+
+// depthParam reads the depth query parameter, defaulting to 1.
+func depthParam(c echo.Context) (int, error) {
+	v, err := queryParam(c, "depth")
+	if err != nil || v == "" {
+		return 1, err
 	}
+	depth, err := intParam(v)
 	if err != nil {
-		return Province{}, err
+		return 0, err
 	}
-	return p, err
+	if depth < 0 || depth > maxDepth {
+		return 0, ErrInvalidDepth
+	}
+	return depth, nil
 }
 
-func (r *Repository) GetCities(ctx context.Context, provinceID int) ([]City, error) {
-	q, args, err := sq.Select("id", "name", "name_english").
-		From("tb_cities").
-		Where(sq.Eq{"province_id": provinceID}).
-		PlaceholderFormat(sq.Dollar).
-		ToSql()
+// provinceSortFields are the fields provinces can be sorted by.
+var provinceSortFields = map[string]bool{"id": true, "name": true, "name_english": true, "code": true, "region": true}
+
+// multiSortParams reads a sort query parameter listing several fields,
+// e.g. "region,-name", applied in order. A field with a leading '-' is
+// sorted descending; the others follow the order parameter.
+func multiSortParams(c echo.Context, allowed map[string]bool) ([]Sort, error) {
+	desc, err := orderParam(c)
 	if err != nil {
 		return nil, err
 	}
-	cities := make([]City, 0)
-	rows, err := r.db.QueryContext(ctx, q, args...)
+	v, err := queryParam(c, "sort")
+	if err != nil || v == "" {
+		return nil, err
+	}
+	return sortList(v, desc, allowed)
+}
+
+// sortList parses a comma-separated list of sort fields as read by
+// multiSortParams, desc being the order of the fields without a '-'.
+func sortList(v string, desc bool, allowed map[string]bool) ([]Sort, error) {
+	var sorts []Sort
+	for _, field := range strings.Split(v, ",") {
+		s := Sort{Field: strings.TrimSpace(field), Desc: desc}
+		if strings.HasPrefix(s.Field, "-") {
+			s.Field, s.Desc = strings.TrimPrefix(s.Field, "-"), true
+		}
+		if !allowed[s.Field] {
+			return nil, fmt.Errorf("%w: '%s'", ErrInvalidSortField, s.Field)
+		}
+		sorts = append(sorts, s)
+	}
+	return sorts, nil
+}
+
+// searchLangs maps the languages a search can be limited to onto the
+// column holding the name in that language.
+var searchLangs = map[string]string{"lo": "name", "en": "name_english"}
+
+// searchLang normalizes the lang of a search. Unknown languages search
+// both names, as no lang does, so they are dropped.
+func searchLang(v string) string {
+	lang := strings.ToLower(strings.TrimSpace(v))
+	if _, ok := searchLangs[lang]; !ok {
+		return ""
+	}
+	return lang
+}
+
+// ErrInvalidParamBool is an error when a boolean param is not valid.
+var ErrInvalidParamBool = errors.New("param: '<attribute>' cannot be applied because the value is not a boolean")
+
+// boolParam reads a boolean query parameter, false when it is not set.
+func boolParam(c echo.Context, name string) (bool, error) {
+	v, err := queryParam(c, name)
+	if err != nil || v == "" {
+		return false, err
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, ErrInvalidParamBool
+	}
+	return b, nil
+}
+
+// provinceFilterParams reads the province list filters from the query:
+// q, lang, fuzzy, has_cities, include_inactive, codes, tag, region, sort,
+// order, limit and offset.
+func provinceFilterParams(c echo.Context) (ProvinceFilter, error) {
+	var f ProvinceFilter
+	q, err := queryParam(c, "q")
+	if err != nil {
+		return f, err
+	}
+	f.Search = strings.TrimSpace(q)
+
+	v, err := queryParam(c, "lang")
+	if err != nil {
+		return f, err
+	}
+	f.Lang = searchLang(v)
+
+	if v, err = queryParam(c, "fuzzy"); err != nil {
+		return f, err
+	}
+	if v != "" {
+		if f.Fuzzy, err = strconv.ParseBool(v); err != nil {
+			return f, ErrInvalidParamBool
+		}
+	}
+
+	if v, err = queryParam(c, "has_cities"); err != nil {
+		return f, err
+	}
+	if v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, ErrInvalidParamBool
+		}
+		f.HasCities = &b
+	}
+	if f.InactiveCities, err = boolParam(c, "include_inactive"); err != nil {
+		return f, err
+	}
+
+	if v, err = queryParam(c, "codes"); err != nil {
+		return f, err
+	}
+	for _, code := range strings.Split(v, ",") {
+		if code = strings.TrimSpace(code); code != "" {
+			f.Codes = append(f.Codes, code)
+		}
+	}
+	if err := checkBatchSize(len(f.Codes), "codes"); err != nil {
+		return f, err
+	}
+
+	if v, err = queryParam(c, "tag"); err != nil {
+		return f, err
+	}
+	if v != "" {
+		if f.Tag, err = tagParam(v); err != nil {
+			return f, err
+		}
+	}
+
+	if v, err = queryParam(c, "region"); err != nil {
+		return f, err
+	}
+	f.Region = strings.TrimSpace(v)
+
+	if f.Sort, err = multiSortParams(c, provinceSortFields); err != nil {
+		return f, err
+	}
+	f.Page, err = pageParams(c)
+	return f, err
+}
+
+// ErrInvalidBBox is an error when a bounding box is missing or malformed.
+var ErrInvalidBBox = errors.New("param: 'bbox' must be 'minLng,minLat,maxLng,maxLat' in degrees")
+
+// bboxParam parses a bounding box given as minLng,minLat,maxLng,maxLat.
+func bboxParam(v string) (BBox, error) {
+	parts := strings.Split(v, ",")
+	if len(parts) != 4 {
+		return BBox{}, ErrInvalidBBox
+	}
+	var f [4]float64
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return BBox{}, ErrInvalidBBox
+		}
+		f[i] = n
+	}
+	b := BBox{MinLng: f[0], MinLat: f[1], MaxLng: f[2], MaxLat: f[3]}
+	if b.MinLng < -180 || b.MaxLng > 180 || b.MinLat < -90 || b.MaxLat > 90 ||
+		b.MinLng > b.MaxLng || b.MinLat > b.MaxLat {
+		return BBox{}, ErrInvalidBBox
+	}
+	return b, nil
+}
+
+// ErrInvalidPoint is an error when a point is missing or malformed.
+var ErrInvalidPoint = errors.New("param: 'lat' and 'lng' must be degrees within -90..90 and -180..180")
+
+// maxNearest is the most provinces a nearest lookup returns.
+const maxNearest = 50
+
+// ErrInvalidNearestLimit is an error when the limit of a nearest lookup is
+// out of range.
+var ErrInvalidNearestLimit = fmt.Errorf("param: 'limit' must be between 1 and %d", maxNearest)
+
+// pointParams reads a point from the lat and lng query parameters.
+func pointParams(c echo.Context) (lng, lat float64, err error) {
+	coord := func(name string, bound float64) (float64, error) {
+		v, err := queryParam(c, name)
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || math.IsNaN(n) || n < -bound || n > bound {
+			return 0, ErrInvalidPoint
+		}
+		return n, nil
+	}
+	if lat, err = coord("lat", 90); err != nil {
+		return 0, 0, err
+	}
+	if lng, err = coord("lng", 180); err != nil {
+		return 0, 0, err
+	}
+	return lng, lat, nil
+}
+
+// ErrInvalidGroup is an error when cities are grouped by an unsupported key.
+var ErrInvalidGroup = errors.New("param: 'group' must be 'alpha'")
+
+// ErrInvalidCities is an error when cities are requested in an unsupported
+// form.
+var ErrInvalidCities = errors.New("param: 'cities' must be 'ids'")
+
+// ErrInvalidOnly is an error when cities are reduced to an unsupported field.
+var ErrInvalidOnly = errors.New("param: 'only' must be 'names'")
+
+type handler struct {
+	service *Service
+}
+
+// NewHandler creates a new handler
+func NewHandler(s *Service) *handler {
+	return &handler{s}
+}
+
+// Healthz reports that the process is alive.
+func (h *handler) Healthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readyz reports whether the service serves live data or is degraded to
+// the snapshot.
+func (h *handler) Readyz(c echo.Context) error {
+	if h.service.Degraded() {
+		return c.JSON(http.StatusOK, map[string]string{"status": "degraded"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// InvalidateCache clears the province cache.
+func (h *handler) InvalidateCache(c echo.Context) error {
+	n := h.service.InvalidateCache()
+	return c.JSON(http.StatusOK, map[string]int{"cleared": n})
+}
+
+// CacheStatsResponse is the JSON view of the cache statistics. Metrics
+// maps the names of the matching /metrics series to their values.
+type CacheStatsResponse struct {
+	Enabled bool `json:"enabled"`
+	CacheStats
+	HitRatio float64            `json:"hit_ratio"`
+	Metrics  map[string]float64 `json:"metrics"`
+}
+
+// CacheStats reports the cache hit and miss counters.
+func (h *handler) CacheStats(c echo.Context) error {
+	stats, ok := h.service.CacheStats()
+	metrics := make(map[string]float64)
+	for _, m := range cacheMetrics(stats) {
+		metrics[m.name] = m.value
+	}
+	return c.JSON(http.StatusOK, CacheStatsResponse{
+		Enabled:    ok,
+		CacheStats: stats,
+		HitRatio:   stats.hitRatio(),
+		Metrics:    metrics,
+	})
+}
+
+// DBStatsResponse is the state of the database connection pool.
+type DBStatsResponse struct {
+	MaxOpenConnections int   `json:"max_open_connections"`
+	OpenConnections    int   `json:"open_connections"`
+	InUse              int   `json:"in_use"`
+	Idle               int   `json:"idle"`
+	WaitCount          int64 `json:"wait_count"`
+	WaitDurationMs     int64 `json:"wait_duration_ms"`
+	MaxIdleClosed      int64 `json:"max_idle_closed"`
+	MaxIdleTimeClosed  int64 `json:"max_idle_time_closed"`
+	MaxLifetimeClosed  int64 `json:"max_lifetime_closed"`
+}
+
+// dbStats reports the connection pool stats of db, e.g. to tell pool
+// exhaustion apart from a slow database.
+func dbStats(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		s := db.Stats()
+		return c.JSON(http.StatusOK, DBStatsResponse{
+			MaxOpenConnections: s.MaxOpenConnections,
+			OpenConnections:    s.OpenConnections,
+			InUse:              s.InUse,
+			Idle:               s.Idle,
+			WaitCount:          s.WaitCount,
+			WaitDurationMs:     s.WaitDuration.Milliseconds(),
+			MaxIdleClosed:      s.MaxIdleClosed,
+			MaxIdleTimeClosed:  s.MaxIdleTimeClosed,
+			MaxLifetimeClosed:  s.MaxLifetimeClosed,
+		})
+	}
+}
+
+// Metrics exposes the metrics in the Prometheus text format.
+func (h *handler) Metrics(c echo.Context) error {
+	stats, _ := h.service.CacheStats()
+	c.Response().Header().Set(echo.HeaderContentType, metricsContentType)
+	c.Response().WriteHeader(http.StatusOK)
+	return writeMetrics(c.Response(), cacheMetrics(stats))
+}
+
+func (h *handler) GetAll(c echo.Context) error {
+	f, err := provinceFilterParams(c)
+	if err != nil {
+		return err
+	}
+	include, err := includeParam(c, "cities", "tags")
+	if err != nil {
+		return err
+	}
+	proj, err := selectParam(c)
+	if err != nil {
+		return err
+	}
+	inc := Include{Tags: include["tags"], Cities: include["cities"], InactiveCities: f.InactiveCities}
+	if proj != nil {
+		f.Fields = proj.columns()
+		inc.Cities = proj.Cities != nil
+	}
+	provinces, total, err := h.service.GetProvinces(c.Request().Context(), f, inc)
+	if err != nil {
+		return err
+	}
+	if f.Page.Limit > 0 {
+		setPaginationHeaders(c, f.Page, total)
+	}
+	if proj != nil {
+		return pageJSON(c, f.Page, proj.provinces(provinces))
+	}
+	if !f.Page.Adjusted {
+		return provinceResponse(c, provinces)
+	}
+	return pageJSON(c, f.Page, provinces)
+}
+
+func (h *handler) GetByID(c echo.Context) error {
+	id, err := intParam(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	inactive, err := boolParam(c, "include_inactive")
+	if err != nil {
+		return err
+	}
+	group, err := queryParam(c, "group")
+	if err != nil {
+		return err
+	}
+	switch group {
+	case "":
+	case "alpha":
+		groups, err := h.service.GetCitiesByLetter(c.Request().Context(), id, inactive)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, groups)
+	default:
+		return ErrInvalidGroup
+	}
+	cities, err := queryParam(c, "cities")
+	if err != nil {
+		return err
+	}
+	switch cities {
+	case "":
+	case "ids":
+		p, err := h.service.GetProvinceWithCityIDs(c.Request().Context(), id, inactive)
+		if err != nil {
+			return err
+		}
+		return provinceResponse(c, p)
+	default:
+		return ErrInvalidCities
+	}
+	depth, err := depthParam(c)
+	if err != nil {
+		return err
+	}
+	sort, err := sortParams(c, citySortFields, "name")
+	if err != nil {
+		return err
+	}
+	include, err := includeParam(c, "cities", "tags")
+	if err != nil {
+		return err
+	}
+	proj, err := selectParam(c)
+	if err != nil {
+		return err
+	}
+	inc := Include{Cities: depth > 0}
+	if len(include) > 0 {
+		// Includes replace the default of loading cities.
+		inc = Include{Tags: include["tags"], Cities: include["cities"]}
+	}
+	inc.InactiveCities = inactive
+	if proj != nil {
+		// The selection decides whether cities are loaded.
+		inc.Cities = proj.Cities != nil
+	}
+	p, err := h.service.GetProvinceByID(c.Request().Context(), id, inc, sort)
+	if err != nil {
+		return err
+	}
+	if p.CitiesUnavailable {
+		c.Response().Header().Set("X-Cities-Unavailable", "true")
+	}
+	if proj != nil {
+		return c.JSON(http.StatusOK, proj.province(*p))
+	}
+	return provinceResponse(c, p)
+}
+
+// GetCities returns a province with its cities, or with only=names just
+// the names of its cities.
+func (h *handler) GetCities(c echo.Context) error {
+	only, err := queryParam(c, "only")
+	if err != nil {
+		return err
+	}
+	switch only {
+	case "":
+		if rng, ok := parseItemsRange(c.Request().Header.Get("Range")); ok {
+			return h.getCityRange(c, rng)
+		}
+		c.Response().Header().Set("Accept-Ranges", "items")
+		return h.GetByID(c)
+	case "names":
+	default:
+		return ErrInvalidOnly
+	}
+	id, err := intParam(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	sort, err := sortParams(c, citySortFields, "name")
+	if err != nil {
+		return err
+	}
+	inactive, err := boolParam(c, "include_inactive")
+	if err != nil {
+		return err
+	}
+	names, err := h.service.GetCityNames(c.Request().Context(), id, sort, inactive)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, names)
+}
+
+// Create creates a province.
+func (h *handler) Create(c echo.Context) error {
+	var in ProvinceInput
+	if err := c.Bind(&in); err != nil {
+		return err
+	}
+	p, err := h.service.CreateProvince(c.Request().Context(), in.Province())
+	if err != nil {
+		return err
+	}
+	location := c.Request().URL.Path + "/" + strconv.Itoa(p.ID)
+	return writeResult(c, http.StatusCreated, location, p)
+}
+
+// GetAllCities lists the cities of every province a page at a time, with
+// include=province adding the name and code of their province.
+func (h *handler) GetAllCities(c echo.Context) error {
+	include, err := includeParam(c, "province")
+	if err != nil {
+		return err
+	}
+	page, err := pageParams(c)
+	if err != nil {
+		return err
+	}
+	if page.Limit == 0 {
+		page.Limit = maxPageSize
+	}
+	inactive, err := boolParam(c, "include_inactive")
+	if err != nil {
+		return err
+	}
+	cities, total, err := h.service.GetAllCities(c.Request().Context(), page, include["province"], inactive)
+	if err != nil {
+		return err
+	}
+	setPaginationHeaders(c, page, total)
+	return pageJSON(c, page, cities)
+}
+
+// GetCitiesByProvinces returns the cities of each of the provinces in the
+// body, keyed by province id. Unknown ids are listed under "missing".
+func (h *handler) GetCitiesByProvinces(c echo.Context) error {
+	var body struct {
+		ProvinceIDs []int `json:"province_ids"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	ids, err := validateIDs(body.ProvinceIDs)
+	if err != nil {
+		return err
+	}
+	inactive, err := boolParam(c, "include_inactive")
+	if err != nil {
+		return err
+	}
+	cities, missing, err := h.service.GetCitiesByProvinceIDs(c.Request().Context(), ids, inactive)
+	if err != nil {
+		return err
+	}
+	result := make(map[string]any, len(cities)+1)
+	for id, list := range cities {
+		result[strconv.Itoa(id)] = list
+	}
+	result["missing"] = missing
+	return c.JSON(http.StatusOK, result)
+}
+
+// UpdateCity updates the fields of a city that are set in the body.
+func (h *handler) UpdateCity(c echo.Context) error {
+	id, err := intParam(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	var fields CityUpdate
+	if err := c.Bind(&fields); err != nil {
+		return err
+	}
+	city, err := h.service.UpdateCity(c.Request().Context(), id, fields)
+	if err != nil {
+		return err
+	}
+	return writeResult(c, http.StatusOK, c.Request().URL.Path, city)
+}
+
+// GetRegions lists the provinces grouped by region.
+func (h *handler) GetRegions(c echo.Context) error {
+	regions, err := h.service.GetRegions(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, regions)
+}
+
+// Resolve returns the province whose id or code is the value query
+// parameter, telling which of the two matched.
+func (h *handler) Resolve(c echo.Context) error {
+	value, err := queryParam(c, "value")
+	if err != nil {
+		return err
+	}
+	if value = strings.TrimSpace(value); value == "" {
+		return ErrMissingValue
+	}
+	p, err := h.service.ResolveProvince(c.Request().Context(), value)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, p)
+}
+
+// Lookup resolves a single province by name and, optionally, region.
+func (h *handler) Lookup(c echo.Context) error {
+	name, err := queryParam(c, "name")
+	if err != nil {
+		return err
+	}
+	if name = strings.TrimSpace(name); name == "" {
+		return ErrMissingName
+	}
+	region, err := queryParam(c, "region")
+	if err != nil {
+		return err
+	}
+	p, err := h.service.FindProvince(c.Request().Context(), name, strings.TrimSpace(region))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, p)
+}
+
+// Within lists the provinces whose boundary intersects a bounding box.
+func (h *handler) Within(c echo.Context) error {
+	v, err := queryParam(c, "bbox")
+	if err != nil {
+		return err
+	}
+	bbox, err := bboxParam(v)
+	if err != nil {
+		return err
+	}
+	provinces, err := h.service.GetProvincesWithin(c.Request().Context(), bbox)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, provinces)
+}
+
+// Centroids returns the centroid of every province with a boundary as a
+// GeoJSON feature collection, e.g. for an overview map.
+func (h *handler) Centroids(c echo.Context) error {
+	centroids, err := h.service.GetCentroids(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentType, geoJSONContentType)
+	return c.JSON(http.StatusOK, centroidFeatures(centroids))
+}
+
+// Nearest lists the provinces nearest to the lat and lng query parameters,
+// the closest first, with their distance in kilometers.
+func (h *handler) Nearest(c echo.Context) error {
+	lng, lat, err := pointParams(c)
+	if err != nil {
+		return err
+	}
+	limit := 5
+	v, err := queryParam(c, "limit")
+	if err != nil {
+		return err
+	}
+	if v != "" {
+		if limit, err = intParam(v); err != nil {
+			return err
+		}
+		if limit < 1 || limit > maxNearest {
+			return ErrInvalidNearestLimit
+		}
+	}
+	provinces, err := h.service.GetNearestProvinces(c.Request().Context(), lng, lat, limit)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, provinces)
+}
+
+// ValidationResult is the result of validating a request body.
+type ValidationResult struct {
+	Valid  bool             `json:"valid"`
+	Errors ValidationErrors `json:"errors,omitempty"`
+}
+
+// Validate runs the create validation on a province without writing it.
+func (h *handler) Validate(c echo.Context) error {
+	var in ProvinceInput
+	if err := c.Bind(&in); err != nil {
+		return err
+	}
+	err := h.service.ValidateProvince(c.Request().Context(), in.Province())
+	var verrs ValidationErrors
+	switch {
+	case err == nil:
+		return c.JSON(http.StatusOK, ValidationResult{Valid: true})
+	case errors.As(err, &verrs):
+		return c.JSON(http.StatusOK, ValidationResult{Errors: verrs})
+	}
+	return err
+}
+
+// Diff compares an uploaded list of provinces with the stored ones.
+func (h *handler) Diff(c echo.Context) error {
+	var in []ProvinceInput
+	if err := c.Bind(&in); err != nil {
+		return err
+	}
+	provinces := make([]Province, len(in))
+	for i, p := range in {
+		provinces[i] = p.Province()
+	}
+	diff, err := h.service.DiffProvinces(c.Request().Context(), provinces)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, diff)
+}
+
+// Exists reports whether a province exists. Unlike the other province
+// routes it answers 200 for a missing province.
+func (h *handler) Exists(c echo.Context) error {
+	id, err := intParam(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	exists, err := h.service.ProvinceExists(c.Request().Context(), id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]bool{"exists": exists})
+}
+
+// CountCities returns the number of cities in a province.
+func (h *handler) CountCities(c echo.Context) error {
+	id, err := intParam(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	inactive, err := boolParam(c, "include_inactive")
+	if err != nil {
+		return err
+	}
+	n, err := h.service.CountCities(c.Request().Context(), id, inactive)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]int{"count": n})
+}
+
+// ExportCities sends the cities of a province as a CSV attachment named
+// after the province code, streaming the rows as they are read from the
+// database. With include_inactive=true an active column tells the inactive
+// cities apart.
+func (h *handler) ExportCities(c echo.Context) error {
+	id, err := intParam(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	inactive, err := boolParam(c, "include_inactive")
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	p, err := h.service.GetProvinceByID(ctx, id, Include{}, Sort{})
+	if err != nil {
+		return err
+	}
+	name := p.Code
+	if name == "" {
+		name = strconv.Itoa(p.ID)
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	res.Header().Set(echo.HeaderContentDisposition,
+		mime.FormatMediaType("attachment", map[string]string{"filename": "cities-" + name + ".csv"}))
+	res.WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(res)
+	header := []string{"id", "name", "name_english"}
+	if inactive {
+		header = append(header, "active")
+	}
+	if err := w.Write(header); err != nil {
+		return nil
+	}
+	err = h.service.StreamCities(ctx, id, inactive, func(city City) error {
+		record := []string{strconv.Itoa(city.ID), city.Name, city.NameEnglish}
+		if inactive {
+			// Without the active column every city is active.
+			record = append(record, strconv.FormatBool(city.Active == nil || *city.Active))
+		}
+		return w.Write(record)
+	})
+	w.Flush()
+	if err == nil {
+		err = w.Error()
+	}
+	if err != nil && ctx.Err() == nil {
+		// The response is already committed, the export is cut short.
+		c.Logger().Error(err)
+	}
+	return nil
+}
+
+// StreamCities streams the cities of a province as Server-Sent Events, one
+// city per event, as they are read from the database.
+func (h *handler) StreamCities(c echo.Context) error {
+	id, err := intParam(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	inactive, err := boolParam(c, "include_inactive")
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	if _, err := h.service.GetProvinceByID(ctx, id, Include{}, Sort{}); err != nil {
+		return err
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	err = h.service.StreamCities(ctx, id, inactive, func(city City) error {
+		data, err := json.Marshal(city)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(res, "data: %s\n\n", data); err != nil {
+			return err
+		}
+		res.Flush()
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		// The response is already committed, report the error in-band.
+		c.Logger().Error(err)
+		fmt.Fprint(res, "event: error\ndata: {\"message\":\"something went wrong\"}\n\n")
+		res.Flush()
+	}
+	return nil
+}
+
+// DeleteMany deletes every province listed in the ids query parameter.
+func (h *handler) DeleteMany(c echo.Context) error {
+	if c.Request().Header.Get("X-Confirm") != "true" {
+		return ErrConfirmationRequired
+	}
+	v, err := queryParam(c, "ids")
+	if err != nil {
+		return err
+	}
+	ids, err := intListParam(v)
+	if err != nil {
+		return err
+	}
+	result, err := h.service.DeleteProvinces(c.Request().Context(), ids)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// GetBatch returns the provinces whose ids are listed in the request body.
+func (h *handler) GetBatch(c echo.Context) error {
+	var body struct {
+		IDs []int `json:"ids"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	ids, err := validateIDs(body.IDs)
+	if err != nil {
+		return err
+	}
+	include, err := includeParam(c, "cities")
+	if err != nil {
+		return err
+	}
+	inactive, err := boolParam(c, "include_inactive")
+	if err != nil {
+		return err
+	}
+	withCities := include["cities"]
+	result, err := h.service.GetProvincesByIDs(c.Request().Context(), ids, withCities, inactive)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// GetByCodes returns the provinces whose codes are listed in the request
+// body, keyed by code as given, with the codes matching no province under
+// "missing".
+func (h *handler) GetByCodes(c echo.Context) error {
+	var body struct {
+		Codes []string `json:"codes"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	codes, err := validateCodes(body.Codes)
+	if err != nil {
+		return err
+	}
+	provinces, missing, err := h.service.GetProvincesByCodes(c.Request().Context(), codes)
+	if err != nil {
+		return err
+	}
+	result := make(map[string]any, len(provinces)+1)
+	for code, p := range provinces {
+		result[code] = p
+	}
+	result["missing"] = missing
+	return c.JSON(http.StatusOK, result)
+}
+
+// maxSearch is the most results a search returns.
+const maxSearch = 100
+
+// ErrInvalidSearchLimit is an error when the limit of a search is out of
+// range.
+var ErrInvalidSearchLimit = fmt.Errorf("param: 'limit' must be between 1 and %d", maxSearch)
+
+// Search returns the provinces and cities matching the q query parameter,
+// best matches first.
+func (h *handler) Search(c echo.Context) error {
+	q, err := queryParam(c, "q")
+	if err != nil {
+		return err
+	}
+	if q = strings.TrimSpace(q); q == "" {
+		return ErrMissingQuery
+	}
+	limit := 20
+	v, err := queryParam(c, "limit")
+	if err != nil {
+		return err
+	}
+	if v != "" {
+		if limit, err = intParam(v); err != nil {
+			return err
+		}
+		if limit < 1 || limit > maxSearch {
+			return ErrInvalidSearchLimit
+		}
+	}
+	results, err := h.service.Search(c.Request().Context(), q, limit)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, results)
+}
+
+// GetTags lists the tags of a province.
+func (h *handler) GetTags(c echo.Context) error {
+	id, err := intParam(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	tags, err := h.service.GetTags(c.Request().Context(), id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, tags)
+}
+
+// AddTag tags a province with the tag given in the request body.
+func (h *handler) AddTag(c echo.Context) error {
+	id, err := intParam(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	var body struct {
+		Tag string `json:"tag"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	tag, err := tagParam(body.Tag)
+	if err != nil {
+		return err
+	}
+	if err := h.service.AddTag(c.Request().Context(), id, tag); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RemoveTag removes a tag from a province.
+func (h *handler) RemoveTag(c echo.Context) error {
+	id, err := intParam(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	tag, err := tagParam(c.Param("tag"))
+	if err != nil {
+		return err
+	}
+	if err := h.service.RemoveTag(c.Request().Context(), id, tag); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ProvinceReader is the read side of the repository.
+type ProvinceReader interface {
+	GetProvinces(ctx context.Context, f ProvinceFilter) ([]Province, error)
+	CountProvinces(ctx context.Context, f ProvinceFilter) (int, error)
+	GetProvincesByIDs(ctx context.Context, ids []int) ([]Province, error)
+	GetProvincesByCodes(ctx context.Context, codes []string) ([]Province, error)
+	GetProvinceByID(ctx context.Context, provinceID int) (Province, error)
+	ProvinceExists(ctx context.Context, provinceID int) (bool, error)
+	GetProvinceByCode(ctx context.Context, code string) (Province, error)
+	GetProvincesWithin(ctx context.Context, bbox BBox) ([]Province, error)
+	GetCentroids(ctx context.Context) ([]Centroid, error)
+	GetNearestProvinces(ctx context.Context, lng, lat float64, limit int) ([]NearbyProvince, error)
+	GetProvincesByRegion(ctx context.Context) ([]Province, error)
+	GetManifest(ctx context.Context) ([]ManifestEntry, error)
+	FindProvince(ctx context.Context, name, region string) (Province, error)
+	Search(ctx context.Context, query string, limit int) ([]SearchResult, error)
+	GetCities(ctx context.Context, provinceID int, sort Sort, page Page, inactive bool) ([]City, error)
+	GetCityNames(ctx context.Context, provinceID int, sort Sort, inactive bool) ([]string, error)
+	GetCityIDs(ctx context.Context, provinceID int, inactive bool) ([]int, error)
+	GetAllCities(ctx context.Context, page Page, withProvince, inactive bool) ([]CityListing, error)
+	DataVersion(ctx context.Context) (string, error)
+	CountAllCities(ctx context.Context, inactive bool) (int, error)
+	CountCities(ctx context.Context, provinceID int, inactive bool) (int, error)
+	GetCitiesByProvinceIDs(ctx context.Context, provinceIDs []int, inactive bool) (map[int][]City, error)
+	GetTags(ctx context.Context, provinceIDs ...int) (map[int][]string, error)
+
+	// StreamCities calls fn for each city of a province, in name order, as
+	// they are read. It stops at the first error returned by fn.
+	StreamCities(ctx context.Context, provinceID int, inactive bool, fn func(City) error) error
+}
+
+// RepositoryIface is the storage used by the service.
+type RepositoryIface interface {
+	ProvinceReader
+
+	CreateProvince(ctx context.Context, p Province) error
+	ImportProvinces(ctx context.Context, provinces []Province) (map[int]bool, error)
+	AddTag(ctx context.Context, provinceID int, tag string) error
+	RemoveTag(ctx context.Context, provinceID int, tag string) error
+	DeleteProvinces(ctx context.Context, ids []int) (*BulkDeleteResult, error)
+	UpdateCity(ctx context.Context, cityID int, fields CityUpdate) (City, error)
+	UpdateProvince(ctx context.Context, provinceID int, fields ProvinceUpdate) (Province, error)
+}
+
+// ServiceConfig holds the settings of the service.
+type ServiceConfig struct {
+	// CodeWidth is the width that province codes are padded to with leading
+	// zeros when read. Codes are stored without the padding.
+	CodeWidth int
+
+	// BatchWindow is how long a lookup of a province by id waits for
+	// concurrent lookups to share its query. Zero disables batching.
+	BatchWindow time.Duration
+
+	// ImportBatchSize is the number of provinces an import inserts per
+	// transaction, and ImportInterval the pause between two batches, which
+	// bounds the load an import puts on the database.
+	ImportBatchSize int
+	ImportInterval  time.Duration
+
+	// ImportMaxErrors is the number of rejected rows past which an import
+	// is aborted.
+	ImportMaxErrors int
+
+	// OptionalCities serves a province without its cities when the cities
+	// table is missing, instead of failing with ErrCitiesUnavailable.
+	OptionalCities bool
+}
+
+type Service struct {
+	repo   RepositoryIface
+	cfg    ServiceConfig
+	loader *provinceLoader
+
+	// provinces shares a lookup of a province between the concurrent
+	// identical requests for it; lookups holds their state, guarded by mu.
+	provinces singleflight.Group
+	mu        sync.Mutex
+	lookups   map[string]*sharedLookup
+}
+
+// sharedLookup is a lookup shared by waiters requests. Its context carries
+// the values of the request that started it, e.g. its traceparent, and is
+// canceled at that request's deadline or once every waiter left.
+type sharedLookup struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// NewService creates a new service
+func NewService(r RepositoryIface, cfg ServiceConfig) *Service {
+	s := &Service{repo: r, cfg: cfg}
+	if cfg.BatchWindow > 0 {
+		s.loader = newProvinceLoader(cfg.BatchWindow, r.GetProvincesByIDs)
+	}
+	return s
+}
+
+// formatCode pads a stored province code to the configured width.
+func (s *Service) formatCode(code string) string {
+	if n := s.cfg.CodeWidth - utf8.RuneCountInString(code); n > 0 && code != "" {
+		return strings.Repeat("0", n) + code
+	}
+	return code
+}
+
+// formatCodes pads the codes of provinces in place.
+func (s *Service) formatCodes(provinces []Province) {
+	for i := range provinces {
+		provinces[i].Code = s.formatCode(provinces[i].Code)
+	}
+}
+
+// normalizeCode upper-cases a province code and strips its zero padding
+// so that codes differing only in case or padding are stored the same way.
+func normalizeCode(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if trimmed := strings.TrimLeft(code, "0"); trimmed != "" {
+		return trimmed
+	}
+	if code != "" {
+		return "0"
+	}
+	return code
+}
+
+// normalizeProvince trims the fields of a province to be written and
+// normalizes its code.
+func normalizeProvince(p Province) Province {
+	p.Code = normalizeCode(p.Code)
+	p.Name = strings.TrimSpace(p.Name)
+	p.NameEnglish = strings.TrimSpace(p.NameEnglish)
+	p.Region = strings.TrimSpace(p.Region)
+	return p
+}
+
+// findRepository looks for a repository of type T in the chain of
+// repositories wrapped by repo.
+func findRepository[T any](repo RepositoryIface) (T, bool) {
+	for repo != nil {
+		if t, ok := repo.(T); ok {
+			return t, true
+		}
+		w, ok := repo.(interface{ Unwrap() RepositoryIface })
+		if !ok {
+			break
+		}
+		repo = w.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
+// Degraded reports whether the repository serves stale data from a
+// snapshot.
+func (s *Service) Degraded() bool {
+	d, ok := findRepository[interface{ Degraded() bool }](s.repo)
+	return ok && d.Degraded()
+}
+
+// CacheStats returns the statistics of the cache; ok is false when
+// caching is disabled.
+func (s *Service) CacheStats() (stats CacheStats, ok bool) {
+	c, ok := findRepository[interface{ Stats() CacheStats }](s.repo)
+	if !ok {
+		return CacheStats{}, false
+	}
+	return c.Stats(), true
+}
+
+// InvalidateCache clears the repository cache, if any, and returns the
+// number of entries cleared.
+func (s *Service) InvalidateCache() int {
+	c, ok := findRepository[interface{ Invalidate() int }](s.repo)
+	if !ok {
+		return 0
+	}
+	return c.Invalidate()
+}
+
+// Include lists the related data to load along with provinces.
+type Include struct {
+	Tags   bool
+	Cities bool
+
+	// InactiveCities keeps the inactive cities among the loaded ones.
+	InactiveCities bool
+}
+
+// GetProvinces lists the provinces selected by f along with the total
+// number of matching provinces. Tags are only loaded when filtering by tag
+// or when included, to keep the common path to a single query.
+func (s *Service) GetProvinces(ctx context.Context, f ProvinceFilter, inc Include) ([]Province, int, error) {
+	for i, code := range f.Codes {
+		f.Codes[i] = normalizeCode(code)
+	}
+	provinces, err := s.repo.GetProvinces(ctx, f)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := len(provinces)
+	if f.Page.Limit > 0 {
+		if total, err = s.repo.CountProvinces(ctx, f); err != nil {
+			return nil, 0, err
+		}
+	}
+	s.formatCodes(provinces)
+	if inc.Cities {
+		if provinces, err = s.withCities(ctx, provinces, inc.InactiveCities); err != nil {
+			return nil, 0, err
+		}
+	}
+	if f.Tag == "" && !inc.Tags {
+		return provinces, total, nil
+	}
+	provinces, err = s.withTags(ctx, provinces)
+	return provinces, total, err
+}
+
+func (s *Service) withCities(ctx context.Context, provinces []Province, inactive bool) ([]Province, error) {
+	if len(provinces) == 0 {
+		return provinces, nil
+	}
+	ids := make([]int, len(provinces))
+	for i, p := range provinces {
+		ids[i] = p.ID
+	}
+	cities, err := s.repo.GetCitiesByProvinceIDs(ctx, ids, inactive)
+	if err != nil {
+		return nil, err
+	}
+	for i := range provinces {
+		assemble(&provinces[i], cities[provinces[i].ID])
+	}
+	return provinces, nil
+}
+
+func (s *Service) withTags(ctx context.Context, provinces []Province) ([]Province, error) {
+	if len(provinces) == 0 {
+		return provinces, nil
+	}
+	ids := make([]int, len(provinces))
+	for i, p := range provinces {
+		ids[i] = p.ID
+	}
+	tags, err := s.repo.GetTags(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+	for i := range provinces {
+		provinces[i].Tags = loaded(tags[provinces[i].ID])
+	}
+	return provinces, nil
+}
+
+func (s *Service) GetTags(ctx context.Context, provinceID int) ([]string, error) {
+	if _, err := s.repo.GetProvinceByID(ctx, provinceID); err != nil {
+		return nil, err
+	}
+	tags, err := s.repo.GetTags(ctx, provinceID)
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := tags[provinceID]; ok {
+		return t, nil
+	}
+	return make([]string, 0), nil
+}
+
+func (s *Service) AddTag(ctx context.Context, provinceID int, tag string) error {
+	if _, err := s.repo.GetProvinceByID(ctx, provinceID); err != nil {
+		return err
+	}
+	return s.repo.AddTag(ctx, provinceID, tag)
+}
+
+func (s *Service) RemoveTag(ctx context.Context, provinceID int, tag string) error {
+	if _, err := s.repo.GetProvinceByID(ctx, provinceID); err != nil {
+		return err
+	}
+	return s.repo.RemoveTag(ctx, provinceID, tag)
+}
+
+// UpdateCity updates the fields of a city that are set and returns the
+// updated city.
+func (s *Service) UpdateCity(ctx context.Context, cityID int, fields CityUpdate) (*City, error) {
+	if fields.empty() {
+		return nil, ErrEmptyUpdate
+	}
+	if verrs := validateCityUpdate(fields); len(verrs) > 0 {
+		return nil, verrs
+	}
+	city, err := s.repo.UpdateCity(ctx, cityID, fields)
+	if err != nil {
+		return nil, err
+	}
+	return &city, nil
+}
+
+// UpdateProvince sets the fields of a province that are set in fields and
+// returns the updated province.
+func (s *Service) UpdateProvince(ctx context.Context, provinceID int, fields ProvinceUpdate) (*Province, error) {
+	if fields.empty() {
+		return nil, ErrEmptyUpdate
+	}
+	fields = normalizeProvinceUpdate(fields)
+	if verrs := validateProvinceUpdate(fields); len(verrs) > 0 {
+		return nil, verrs
+	}
+	p, err := s.repo.UpdateProvince(ctx, provinceID, fields)
+	if err != nil {
+		return nil, err
+	}
+	p.Code = s.formatCode(p.Code)
+	return &p, nil
+}
+
+// GetProvinceByID returns a province with the included related data
+// loaded; cities are loaded in the given order. Concurrent identical
+// lookups share a single one, run under the context of the first request
+// until every request waiting for it is gone; errors are only shared
+// within the lookup.
+func (s *Service) GetProvinceByID(ctx context.Context, provinceID int, inc Include, sort Sort) (*Province, error) {
+	key := fmt.Sprintf("%d:%t:%t:%t:%s", provinceID, inc.Tags, inc.Cities, inc.InactiveCities, sort)
+	// Joining the lookup and the singleflight call under mu keeps them
+	// paired.
+	s.mu.Lock()
+	l, ok := s.lookups[key]
+	if !ok {
+		l = &sharedLookup{}
+		l.ctx, l.cancel = sharedContext(ctx)
+		if s.lookups == nil {
+			s.lookups = make(map[string]*sharedLookup)
+		}
+		s.lookups[key] = l
+	}
+	l.waiters++
+	ch := s.provinces.DoChan(key, func() (any, error) {
+		defer func() {
+			s.mu.Lock()
+			s.endLookup(key, l)
+			s.mu.Unlock()
+		}()
+		return s.getProvinceByID(l.ctx, provinceID, inc, sort)
+	})
+	s.mu.Unlock()
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		// Callers get their own copy as they may modify it.
+		p := *res.Val.(*Province)
+		return &p, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		if l.waiters--; l.waiters == 0 {
+			s.endLookup(key, l)
+		}
+		s.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// endLookup cancels the lookup for key, and forgets it so that the next
+// request starts a new one. The caller must hold mu.
+func (s *Service) endLookup(key string, l *sharedLookup) {
+	l.cancel()
+	if s.lookups[key] == l {
+		delete(s.lookups, key)
+		s.provinces.Forget(key)
+	}
+}
+
+// sharedContext returns a context with the values and the deadline of ctx
+// that is not canceled along with it, for work shared with other requests.
+func sharedContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	shared := context.Context(valuesContext{ctx})
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(shared, deadline)
+	}
+	return context.WithCancel(shared)
+}
+
+// valuesContext has the values of its parent but neither its deadline nor
+// its cancellation.
+type valuesContext struct {
+	parent context.Context
+}
+
+func (valuesContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (valuesContext) Done() <-chan struct{}       { return nil }
+func (valuesContext) Err() error                  { return nil }
+
+func (c valuesContext) Value(key any) any { return c.parent.Value(key) }
+
+func (s *Service) getProvinceByID(ctx context.Context, provinceID int, inc Include, sort Sort) (*Province, error) {
+	p, err := s.provinceByID(ctx, provinceID)
+	if err != nil {
+		return nil, err
+	}
+	p.Code = s.formatCode(p.Code)
+	if inc.Tags {
+		tags, err := s.repo.GetTags(ctx, provinceID)
+		if err != nil {
+			return nil, err
+		}
+		p.Tags = loaded(tags[provinceID])
+	}
+	if !inc.Cities {
+		return &p, nil
+	}
+	cities, err := s.repo.GetCities(ctx, provinceID, sort, Page{}, inc.InactiveCities)
+	if s.cfg.OptionalCities && errors.Is(err, ErrCitiesUnavailable) {
+		p.CitiesUnavailable = true
+		return &p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return assemble(&p, cities), nil
+}
+
+// GetCityPage returns a page of the cities of a province along with the
+// total number of its cities, leaving out the inactive ones unless inactive
+// is set.
+func (s *Service) GetCityPage(ctx context.Context, provinceID int, sort Sort, page Page, inactive bool) ([]City, int, error) {
+	if _, err := s.provinceByID(ctx, provinceID); err != nil {
+		return nil, 0, err
+	}
+	total, err := s.repo.CountCities(ctx, provinceID, inactive)
+	if err != nil {
+		return nil, 0, err
+	}
+	if page.Offset >= total {
+		return make([]City, 0), total, nil
+	}
+	cities, err := s.repo.GetCities(ctx, provinceID, sort, page, inactive)
+	if err != nil {
+		return nil, 0, err
+	}
+	return cities, total, nil
+}
+
+// GetAllCities lists a page of the cities of every province along with the
+// total number of cities.
+func (s *Service) GetAllCities(ctx context.Context, page Page, withProvince, inactive bool) ([]CityListing, int, error) {
+	cities, err := s.repo.GetAllCities(ctx, page, withProvince, inactive)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := s.repo.CountAllCities(ctx, inactive)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range cities {
+		cities[i].ProvinceCode = s.formatCode(cities[i].ProvinceCode)
+	}
+	return cities, total, nil
+}
+
+// GetProvinceWithCityIDs returns a province with the ids of its cities in
+// place of the cities.
+func (s *Service) GetProvinceWithCityIDs(ctx context.Context, provinceID int, inactive bool) (*Province, error) {
+	p, err := s.provinceByID(ctx, provinceID)
+	if err != nil {
+		return nil, err
+	}
+	p.Code = s.formatCode(p.Code)
+	if p.CityIDs, err = s.repo.GetCityIDs(ctx, provinceID, inactive); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// provinceByID looks up a province, batching the lookup with concurrent
+// ones when enabled.
+func (s *Service) provinceByID(ctx context.Context, provinceID int) (Province, error) {
+	if s.loader != nil {
+		return s.loader.Load(ctx, provinceID)
+	}
+	return s.repo.GetProvinceByID(ctx, provinceID)
+}
+
+// GetCityNames returns the names of the cities of a province in the given
+// order.
+func (s *Service) GetCityNames(ctx context.Context, provinceID int, sort Sort, inactive bool) ([]string, error) {
+	if _, err := s.repo.GetProvinceByID(ctx, provinceID); err != nil {
+		return nil, err
+	}
+	return s.repo.GetCityNames(ctx, provinceID, sort, inactive)
+}
+
+// GetCitiesByLetter returns the cities of a province grouped under the
+// upper-cased first character of their name, sorted by name within each
+// group.
+func (s *Service) GetCitiesByLetter(ctx context.Context, provinceID int, inactive bool) (map[string][]City, error) {
+	if _, err := s.repo.GetProvinceByID(ctx, provinceID); err != nil {
+		return nil, err
+	}
+	cities, err := s.repo.GetCities(ctx, provinceID, Sort{Field: "name"}, Page{}, inactive)
+	if err != nil {
+		return nil, err
+	}
+	return groupByLetter(cities), nil
+}
+
+// groupByLetter groups cities by the first character of their name. Names
+// in non-Latin scripts are grouped by their first character as-is.
+func groupByLetter(cities []City) map[string][]City {
+	groups := make(map[string][]City)
+	for _, c := range cities {
+		r, _ := utf8.DecodeRuneInString(c.Name)
+		if r == utf8.RuneError {
+			continue
+		}
+		letter := strings.ToUpper(string(r))
+		groups[letter] = append(groups[letter], c)
+	}
+	return groups
+}
+
+// ValidateProvince checks that p can be stored as a new province: its
+// fields must be well-formed and its id and code must not be in use.
+func (s *Service) ValidateProvince(ctx context.Context, p Province) error {
+	p = normalizeProvince(p)
+	verrs := validateProvince(p)
+	if p.ID > 0 {
+		_, err := s.repo.GetProvinceByID(ctx, p.ID)
+		switch {
+		case err == nil:
+			verrs = append(verrs, FieldError{"id", "is already in use"})
+		case !errors.Is(err, ErrUnknownProvince):
+			return err
+		}
+	}
+	if p.Code != "" {
+		_, err := s.repo.GetProvinceByCode(ctx, p.Code)
+		switch {
+		case err == nil:
+			verrs = append(verrs, FieldError{"code", "is already in use"})
+		case !errors.Is(err, ErrUnknownProvince):
+			return err
+		}
+	}
+	if len(verrs) > 0 {
+		return verrs
+	}
+	return nil
+}
+
+func (s *Service) CreateProvince(ctx context.Context, p Province) (*Province, error) {
+	p = normalizeProvince(p)
+	if err := s.ValidateProvince(ctx, p); err != nil {
+		return nil, err
+	}
+	if err := s.repo.CreateProvince(ctx, p); err != nil {
+		return nil, err
+	}
+	p.Code = s.formatCode(p.Code)
+	return &p, nil
+}
+
+func (s *Service) Search(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	results, err := s.repo.Search(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].Code = s.formatCode(results[i].Code)
+	}
+	return results, nil
+}
+
+// ResolvedProvince is a province resolved from an identifier of unknown
+// kind, with the kind it matched: "id" or "code".
+type ResolvedProvince struct {
+	ID          int    `json:"id"`
+	Code        string `json:"code"`
+	Name        string `json:"name"`
+	NameEnglish string `json:"name_english,omitempty"`
+	Region      string `json:"region,omitempty"`
+	MatchedBy   string `json:"matched_by"`
+}
+
+// ResolveProvince resolves a province by a value that may be its id or its
+// code, trying the id first when the value is a number, so that "5" is the
+// province with id 5 before the one with code 05.
+func (s *Service) ResolveProvince(ctx context.Context, value string) (*ResolvedProvince, error) {
+	var p Province
+	matchedBy, err := "id", ErrUnknownProvince
+	if id, idErr := intParam(value); idErr == nil && id > 0 {
+		p, err = s.repo.GetProvinceByID(ctx, id)
+	}
+	if errors.Is(err, ErrUnknownProvince) {
+		matchedBy = "code"
+		p, err = s.repo.GetProvinceByCode(ctx, normalizeCode(value))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ResolvedProvince{
+		ID:          p.ID,
+		Code:        s.formatCode(p.Code),
+		Name:        p.Name,
+		NameEnglish: p.NameEnglish,
+		Region:      p.Region,
+		MatchedBy:   matchedBy,
+	}, nil
+}
+
+// FindProvince resolves a province by name within a region.
+func (s *Service) FindProvince(ctx context.Context, name, region string) (*Province, error) {
+	p, err := s.repo.FindProvince(ctx, name, region)
+	if err != nil {
+		return nil, err
+	}
+	p.Code = s.formatCode(p.Code)
+	return &p, nil
+}
+
+// GetRegions lists every province grouped by region.
+func (s *Service) GetRegions(ctx context.Context) ([]Region, error) {
+	provinces, err := s.repo.GetProvincesByRegion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.formatCodes(provinces)
+	return groupByRegion(provinces), nil
+}
+
+// groupByRegion groups provinces ordered by region into regions, keeping
+// their order. Provinces without a region are grouped under
+// UnassignedRegion, which comes last.
+func groupByRegion(provinces []Province) []Region {
+	regions := make([]Region, 0)
+	var unassigned []Province
+	for _, p := range provinces {
+		if p.Region == "" {
+			unassigned = append(unassigned, p)
+			continue
+		}
+		if n := len(regions); n == 0 || regions[n-1].Region != p.Region {
+			regions = append(regions, Region{Region: p.Region})
+		}
+		regions[len(regions)-1].Provinces = append(regions[len(regions)-1].Provinces, p)
+	}
+	if len(unassigned) > 0 {
+		regions = append(regions, Region{Region: UnassignedRegion, Provinces: unassigned})
+	}
+	return regions
+}
+
+// GetProvincesWithin lists the provinces whose boundary intersects bbox.
+func (s *Service) GetProvincesWithin(ctx context.Context, bbox BBox) ([]Province, error) {
+	provinces, err := s.repo.GetProvincesWithin(ctx, bbox)
+	if err != nil {
+		return nil, err
+	}
+	s.formatCodes(provinces)
+	return provinces, nil
+}
+
+// GetCentroids lists the centroids of the provinces that have a boundary.
+func (s *Service) GetCentroids(ctx context.Context) ([]Centroid, error) {
+	centroids, err := s.repo.GetCentroids(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range centroids {
+		centroids[i].Code = s.formatCode(centroids[i].Code)
+	}
+	return centroids, nil
+}
+
+// GetNearestProvinces lists the limit provinces whose centroid is nearest
+// to the point, the closest first.
+func (s *Service) GetNearestProvinces(ctx context.Context, lng, lat float64, limit int) ([]NearbyProvince, error) {
+	provinces, err := s.repo.GetNearestProvinces(ctx, lng, lat, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range provinces {
+		provinces[i].Code = s.formatCode(provinces[i].Code)
+	}
+	return provinces, nil
+}
+
+// DataVersion returns a token that changes whenever the dataset does.
+func (s *Service) DataVersion(ctx context.Context) (string, error) {
+	return s.repo.DataVersion(ctx)
+}
+
+func (s *Service) ProvinceExists(ctx context.Context, provinceID int) (bool, error) {
+	return s.repo.ProvinceExists(ctx, provinceID)
+}
+
+func (s *Service) StreamCities(ctx context.Context, provinceID int, inactive bool, fn func(City) error) error {
+	return s.repo.StreamCities(ctx, provinceID, inactive, fn)
+}
+
+func (s *Service) CountCities(ctx context.Context, provinceID int, inactive bool) (int, error) {
+	if _, err := s.repo.GetProvinceByID(ctx, provinceID); err != nil {
+		return 0, err
+	}
+	return s.repo.CountCities(ctx, provinceID, inactive)
+}
+
+// GetCitiesByProvinceIDs returns the cities of each of the provinces with
+// the given ids, and the ids of the provinces that do not exist. Provinces
+// without cities map to an empty list.
+func (s *Service) GetCitiesByProvinceIDs(ctx context.Context, ids []int, inactive bool) (map[int][]City, []int, error) {
+	provinces, err := s.repo.GetProvincesByIDs(ctx, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	found := make(map[int]bool, len(provinces))
+	for _, p := range provinces {
+		found[p.ID] = true
+	}
+	missing := make([]int, 0)
+	for _, id := range ids {
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+	result := make(map[int][]City, len(provinces))
+	if len(provinces) == 0 {
+		return result, missing, nil
+	}
+
+	cities, err := s.repo.GetCitiesByProvinceIDs(ctx, ids, inactive)
+	if err != nil {
+		return nil, nil, err
+	}
+	for id := range found {
+		result[id] = cities[id]
+		if result[id] == nil {
+			result[id] = make([]City, 0)
+		}
+	}
+	return result, missing, nil
+}
+
+// GetProvincesByCodes returns the provinces matching codes, keyed by the
+// code as given, together with the codes that matched nothing. Codes match
+// whatever their case or padding.
+func (s *Service) GetProvincesByCodes(ctx context.Context, codes []string) (map[string]Province, []string, error) {
+	normalized := make([]string, len(codes))
+	for i, code := range codes {
+		normalized[i] = normalizeCode(code)
+	}
+	provinces, err := s.repo.GetProvincesByCodes(ctx, normalized)
+	if err != nil {
+		return nil, nil, err
+	}
+	// A code shared by several provinces resolves to the first, by id.
+	// The stored codes may differ from the normalized ones in case.
+	byCode := make(map[string]Province, len(provinces))
+	for _, p := range provinces {
+		code := strings.ToUpper(p.Code)
+		if _, ok := byCode[code]; !ok {
+			byCode[code] = p
+		}
+	}
+	result := make(map[string]Province, len(provinces))
+	missing := make([]string, 0)
+	for i, code := range codes {
+		p, ok := byCode[normalized[i]]
+		if !ok {
+			missing = append(missing, code)
+			continue
+		}
+		p.Code = s.formatCode(p.Code)
+		result[code] = p
+	}
+	return result, missing, nil
+}
+
+// GetProvincesByIDs returns the provinces matching ids, in the order of ids,
+// together with the ids that matched nothing.
+func (s *Service) GetProvincesByIDs(ctx context.Context, ids []int, withCities, inactive bool) (*BatchResult, error) {
+	provinces, err := s.repo.GetProvincesByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]Province, len(provinces))
+	for _, p := range provinces {
+		p.Code = s.formatCode(p.Code)
+		byID[p.ID] = p
+	}
+	result := &BatchResult{
+		Provinces: make([]Province, 0, len(provinces)),
+		Missing:   make([]int, 0),
+	}
+	for _, id := range ids {
+		p, ok := byID[id]
+		if !ok {
+			result.Missing = append(result.Missing, id)
+			continue
+		}
+		result.Provinces = append(result.Provinces, p)
+	}
+	if !withCities || len(result.Provinces) == 0 {
+		return result, nil
+	}
+
+	cities, err := s.repo.GetCitiesByProvinceIDs(ctx, ids, inactive)
+	if err != nil {
+		return nil, err
+	}
+	for i := range result.Provinces {
+		assemble(&result.Provinces[i], cities[result.Provinces[i].ID])
+	}
+	return result, nil
+}
+
+// DiffProvinces compares provinces with the stored ones, matching them by
+// code. A stored code shared by several provinces matches the one with the
+// lowest id.
+func (s *Service) DiffProvinces(ctx context.Context, provinces []Province) (*ProvinceDiff, error) {
+	var verrs ValidationErrors
+	uploaded := make(map[string]bool, len(provinces))
+	for i := range provinces {
+		provinces[i] = normalizeProvince(provinces[i])
+		code := provinces[i].Code
+		switch {
+		case code == "":
+			verrs = append(verrs, FieldError{fmt.Sprintf("[%d].code", i), "is required"})
+		case uploaded[code]:
+			verrs = append(verrs, FieldError{fmt.Sprintf("[%d].code", i), "is duplicated"})
+		}
+		uploaded[code] = true
+	}
+	if len(verrs) > 0 {
+		return nil, verrs
+	}
+
+	current, err := s.repo.GetProvinces(ctx, ProvinceFilter{})
+	if err != nil {
+		return nil, err
+	}
+	byCode := make(map[string]Province, len(current))
+	for _, p := range current {
+		if _, ok := byCode[p.Code]; !ok {
+			byCode[p.Code] = p
+		}
+	}
+
+	diff := &ProvinceDiff{New: make([]Province, 0), Changed: make([]Province, 0), Missing: make([]Province, 0)}
+	for _, p := range provinces {
+		old, ok := byCode[p.Code]
+		switch {
+		case !ok:
+			diff.New = append(diff.New, p)
+		case (p.ID != 0 && p.ID != old.ID) || p.Name != old.Name ||
+			p.NameEnglish != old.NameEnglish || p.Region != old.Region:
+			diff.Changed = append(diff.Changed, p)
+		}
+	}
+	for code, p := range byCode {
+		if !uploaded[code] {
+			diff.Missing = append(diff.Missing, p)
+		}
+	}
+	sort.Slice(diff.Missing, func(i, j int) bool { return diff.Missing[i].ID < diff.Missing[j].ID })
+	s.formatCodes(diff.New)
+	s.formatCodes(diff.Changed)
+	s.formatCodes(diff.Missing)
+	return diff, nil
+}
+
+func (s *Service) DeleteProvinces(ctx context.Context, ids []int) (*BulkDeleteResult, error) {
+	return s.repo.DeleteProvinces(ctx, ids)
+}
+
+func assemble(province *Province, cities []City) *Province {
+	province.Cities = loaded(cities)
+	return province
+}
+
+// ErrUnknownProvince is returned when a province could not be found.
+var ErrUnknownProvince = errors.New("province could not be found")
+
+// Province represents a province.
+type Province struct {
+	ID          int    `json:"id"`
+	Code        string `json:"code"`
+	Name        string `json:"name"`
+	NameEnglish string `json:"name_english,omitempty"`
+
+	// Region is the region the province belongs to, e.g. "North".
+	Region string `json:"region,omitempty"`
+
+	// Cities represents a list of cities in the province.
+	Cities []City `json:"cities,omitempty"`
+
+	// CityIDs lists the ids of the cities when they are requested in place
+	// of the cities.
+	CityIDs []int `json:"city_ids,omitempty"`
+
+	// Tags represents the tags attached to the province, e.g. "northern".
+	Tags []string `json:"tags,omitempty"`
+
+	// CitiesUnavailable is set when the cities were requested but left out
+	// as they are unavailable; see ServiceConfig.OptionalCities.
+	CitiesUnavailable bool `json:"-"`
+}
+
+// keepEmptyCollections sends the loaded collections of a province, such as
+// its cities, as [] when they are empty instead of leaving them out.
+// Collections that were not loaded are left out either way.
+var keepEmptyCollections bool
+
+// MarshalJSON leaves out empty collections unless keepEmptyCollections is
+// set.
+func (p Province) MarshalJSON() ([]byte, error) {
+	type province Province // without the MarshalJSON method
+	if !keepEmptyCollections {
+		return json.Marshal(province(p))
+	}
+	// The pointers shadow the embedded fields and are only nil, and left
+	// out, when the collection was not loaded.
+	v := struct {
+		province
+		Cities  *[]City   `json:"cities,omitempty"`
+		CityIDs *[]int    `json:"city_ids,omitempty"`
+		Tags    *[]string `json:"tags,omitempty"`
+	}{province: province(p)}
+	if p.Cities != nil {
+		v.Cities = &p.Cities
+	}
+	if p.CityIDs != nil {
+		v.CityIDs = &p.CityIDs
+	}
+	if p.Tags != nil {
+		v.Tags = &p.Tags
+	}
+	return json.Marshal(v)
+}
+
+// loaded returns s, or an empty slice when s is nil, to tell a loaded but
+// empty collection from one that was not loaded.
+func loaded[T any](s []T) []T {
+	if s == nil {
+		return make([]T, 0)
+	}
+	return s
+}
+
+// UnassignedRegion groups the provinces that have no region.
+const UnassignedRegion = "Unassigned"
+
+// Region is a group of provinces.
+type Region struct {
+	Region    string     `json:"region"`
+	Provinces []Province `json:"provinces"`
+}
+
+// Search result types.
+const (
+	SearchTypeProvince = "province"
+	SearchTypeCity     = "city"
+)
+
+// SearchResult is a province or a city matching a search query; Type tells
+// which one it is.
+type SearchResult struct {
+	Type        string `json:"type"`
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	NameEnglish string `json:"name_english,omitempty"`
+
+	// Code is only set for provinces.
+	Code string `json:"code,omitempty"`
+
+	// ProvinceID is only set for cities.
+	ProvinceID int `json:"province_id,omitempty"`
+
+	Rank float64 `json:"rank"`
+}
+
+// ProvinceInput is the request body for writing a province.
+type ProvinceInput struct {
+	ID          int    `json:"id"`
+	Code        string `json:"code"`
+	Name        string `json:"name"`
+	NameEnglish string `json:"name_english"`
+	Region      string `json:"region"`
+}
+
+// Province converts the input to a province.
+func (in ProvinceInput) Province() Province {
+	return Province{
+		ID:          in.ID,
+		Code:        in.Code,
+		Name:        in.Name,
+		NameEnglish: in.NameEnglish,
+		Region:      in.Region,
+	}
+}
+
+// ErrAmbiguousProvince is returned when a lookup matches several provinces.
+var ErrAmbiguousProvince = errors.New("province lookup matches more than one province")
+
+// ErrProvinceExists is returned when creating a province whose id or code is
+// taken.
+var ErrProvinceExists = errors.New("province already exists")
+
+// FieldError describes why a field of a request body is invalid.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is returned when a request body has invalid fields.
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	return fmt.Sprintf("request body has %d invalid field(s)", len(v))
+}
+
+// validateProvince checks the format of the province fields.
+func validateProvince(p Province) ValidationErrors {
+	var verrs ValidationErrors
+	if p.ID <= 0 || p.ID > math.MaxInt32 {
+		verrs = append(verrs, FieldError{"id", "must be a positive 32-bit integer"})
+	}
+	if n := utf8.RuneCountInString(p.Code); n == 0 || n > 5 {
+		verrs = append(verrs, FieldError{"code", "must be 1-5 characters"})
+	}
+	if n := utf8.RuneCountInString(p.Name); n == 0 || n > 100 {
+		verrs = append(verrs, FieldError{"name", "must be 1-100 characters"})
+	}
+	if utf8.RuneCountInString(p.NameEnglish) > 100 {
+		verrs = append(verrs, FieldError{"name_english", "must be at most 100 characters"})
+	}
+	if utf8.RuneCountInString(p.Region) > 50 {
+		verrs = append(verrs, FieldError{"region", "must be at most 50 characters"})
+	}
+	return verrs
+}
+
+// City represents a city.
+type City struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	NameEnglish string `json:"name_english,omitempty"`
+
+	// Active tells whether the city is active, when inactive cities were
+	// requested along with the active ones.
+	Active *bool `json:"active,omitempty"`
+}
+
+// ErrCitiesUnavailable is returned when the cities table does not exist,
+// e.g. on a mirror replicating only the provinces.
+var ErrCitiesUnavailable = errors.New("cities are unavailable")
+
+// ErrUnknownCity is returned when a city could not be found.
+var ErrUnknownCity = errors.New("city not found")
+
+// ErrEmptyUpdate is returned when an update sets none of the fields.
+var ErrEmptyUpdate = errors.New("request body: at least one field must be set")
+
+// CityUpdate holds the fields of a city to update; nil fields are left
+// unchanged.
+type CityUpdate struct {
+	Name        *string `json:"name"`
+	NameEnglish *string `json:"name_english"`
+}
+
+func (u CityUpdate) empty() bool {
+	return u.Name == nil && u.NameEnglish == nil
+}
+
+// validateCityUpdate checks the format of the fields that are set.
+func validateCityUpdate(u CityUpdate) ValidationErrors {
+	var verrs ValidationErrors
+	if u.Name != nil {
+		if n := utf8.RuneCountInString(*u.Name); n == 0 || n > 100 {
+			verrs = append(verrs, FieldError{"name", "must be 1-100 characters"})
+		}
+	}
+	if u.NameEnglish != nil && utf8.RuneCountInString(*u.NameEnglish) > 100 {
+		verrs = append(verrs, FieldError{"name_english", "must be at most 100 characters"})
+	}
+	return verrs
+}
+
+// CityListing is a city in the list of the cities of every province. The
+// name and code of the province are only set when requested.
+type CityListing struct {
+	City
+	ProvinceID   int    `json:"province_id"`
+	ProvinceName string `json:"province_name,omitempty"`
+	ProvinceCode string `json:"province_code,omitempty"`
+}
+
+// Page selects a window of a list. A zero Limit selects every item.
+type Page struct {
+	Limit  int
+	Offset int
+
+	// Adjusted is set when the requested limit was clamped to maxPageSize.
+	Adjusted bool
+}
+
+// apply adds the page bounds to a query.
+func (p Page) apply(b sq.SelectBuilder) sq.SelectBuilder {
+	if p.Limit > 0 {
+		b = b.Limit(uint64(p.Limit))
+	}
+	if p.Offset > 0 {
+		b = b.Offset(uint64(p.Offset))
+	}
+	return b
+}
+
+// ProvinceFilter selects, orders and paginates provinces. The zero value
+// selects every province.
+type ProvinceFilter struct {
+	// Search matches a case-insensitive substring of either name.
+	Search string
+
+	// Lang, when one of searchLangs, limits Search to the name in that
+	// language.
+	Lang string
+
+	// Fuzzy, with Search, matches English names similar to Search instead,
+	// tolerating typos, most similar first.
+	Fuzzy bool
+
+	// HasCities, when set, keeps only the provinces with (or without) cities.
+	HasCities *bool
+
+	// InactiveCities counts the inactive cities for HasCities.
+	InactiveCities bool
+
+	// Codes keeps only the provinces with one of the given normalized codes,
+	// ignoring case.
+	Codes []string
+
+	// Tag keeps only the provinces carrying the tag.
+	Tag string
+
+	// Region keeps only the provinces of the region; UnassignedRegion keeps
+	// the provinces without one.
+	Region string
+
+	// Fields, when set, limits the loaded columns to the given ones; the
+	// other fields may be left empty.
+	Fields []string
+
+	// Sort orders the provinces by each field in turn; without any they
+	// are ordered by id. The fields must come from an allowlist as they are
+	// interpolated into the query.
+	Sort []Sort
+
+	Page Page
+}
+
+// BBox is a bounding box in WGS 84 degrees.
+type BBox struct {
+	MinLng, MinLat float64
+	MaxLng, MaxLat float64
+}
+
+// Sort orders a list by a single field.
+type Sort struct {
+	Field string
+	Desc  bool
+}
+
+// String returns the ORDER BY expression of the sort.
+func (s Sort) String() string {
+	if s.Desc {
+		return s.Field + " DESC"
+	}
+	return s.Field + " ASC"
+}
+
+// orderBy returns the ORDER BY expressions of sorts, prefixed with the
+// table alias, followed by id unless they already order by it: the order
+// of rows with equal keys is otherwise up to the database and may change
+// between two queries, which breaks pagination.
+func orderBy(alias string, sorts ...Sort) []string {
+	exprs := make([]string, 0, len(sorts)+1)
+	for _, s := range sorts {
+		exprs = append(exprs, alias+s.String())
+		if s.Field == "id" {
+			return exprs
+		}
+	}
+	return append(exprs, alias+"id ASC")
+}
+
+// BatchResult is the result of looking up several provinces by id.
+type BatchResult struct {
+	Provinces []Province `json:"provinces"`
+
+	// Missing lists the requested ids that did not match any province.
+	Missing []int `json:"missing"`
+}
+
+// ProvinceDiff is the difference between an uploaded list of provinces and
+// the stored ones.
+type ProvinceDiff struct {
+	// New lists the uploaded provinces whose code is not stored.
+	New []Province `json:"new"`
+
+	// Changed lists the uploaded provinces whose fields differ from the
+	// stored province with the same code.
+	Changed []Province `json:"changed"`
+
+	// Missing lists the stored provinces whose code was not uploaded.
+	Missing []Province `json:"missing"`
+}
+
+// BulkDeleteResult reports the outcome of deleting several provinces at once.
+type BulkDeleteResult struct {
+	Deleted int `json:"deleted"`
+
+	// Missing lists the requested ids that did not match any province.
+	Missing []int `json:"missing"`
+
+	// Conflicts lists the ids that were kept because they still have cities.
+	Conflicts []int `json:"conflicts"`
+}
+
+type Repository struct {
+	db     tracedDB
+	tables tables
+
+	// schema and names locate the tables for detectFeatures.
+	schema string
+	names  TableNames
+
+	// cityActive is set when the cities table has the active column of
+	// migration 000008; without it every city is active.
+	cityActive bool
+
+	// similarity is the pg_trgm similarity above which fuzzy searches
+	// match; 0 when pg_trgm is not installed, in which case fuzzy searches
+	// match substrings.
+	similarity float64
+
+	// fuzzyThreshold is the similarity used once pg_trgm is found.
+	fuzzyThreshold float64
+}
+
+// TableNames are the unqualified names of the tables of the repository.
+// They are interpolated into queries and must be valid identifiers.
+type TableNames struct {
+	Provinces    string
+	Cities       string
+	ProvinceTags string
+}
+
+// tables holds the table names used in queries, qualified with the schema
+// when one is configured.
+type tables struct {
+	provinces    string
+	cities       string
+	provinceTags string
+	dataVersion  string
+}
+
+// NewRepository creates a new repository. When schema is not empty the
+// tables are looked up in that schema instead of the search_path.
+func NewRepository(db *sql.DB, schema string, names TableNames) *Repository {
+	qualify := func(table string) string {
+		if schema == "" {
+			return table
+		}
+		return schema + "." + table
+	}
+	return &Repository{
+		db: tracedDB{db},
+		tables: tables{
+			provinces:    qualify(names.Provinces),
+			cities:       qualify(names.Cities),
+			provinceTags: qualify(names.ProvinceTags),
+			dataVersion:  qualify("tb_data_version"),
+		},
+		schema: schema,
+		names:  names,
+	}
+}
+
+// identifierPattern matches unquoted SQL identifiers that are safe to
+// interpolate into queries.
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
+
+// validateIdentifier checks that name is a plain SQL identifier.
+func validateIdentifier(name string) error {
+	if !identifierPattern.MatchString(name) {
+		return fmt.Errorf("%q is not a valid SQL identifier", name)
+	}
+	return nil
+}
+
+// GetProvinces lists the provinces selected by f.
+func (r *Repository) GetProvinces(ctx context.Context, f ProvinceFilter) ([]Province, error) {
+	columns := f.Fields
+	if len(columns) == 0 {
+		columns = provinceColumns
+	}
+	selected := make([]string, len(columns))
+	for i, col := range columns {
+		selected[i] = "p." + col
+	}
+	b := r.filterProvinces(sq.Select(selected...), f)
+	switch {
+	case len(f.Sort) > 0:
+		b = b.OrderBy(orderBy("p.", f.Sort...)...)
+	case r.fuzzy(f):
+		b = b.OrderByClause("similarity(p.name_english, ?) DESC, p.id ASC", f.Search)
+	default:
+		b = b.OrderBy("p.id ASC")
+	}
+	q, args, err := f.Page.apply(b).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	provinces := make([]Province, 0)
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanProvinceColumns(rows.Scan, columns)
+		if err != nil {
+			return nil, err
+		}
+		provinces = append(provinces, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return provinces, nil
+}
+
+// CountProvinces counts the provinces selected by f, ignoring its page.
+func (r *Repository) CountProvinces(ctx context.Context, f ProvinceFilter) (int, error) {
+	q, args, err := r.filterProvinces(sq.Select("COUNT(*)"), f).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return 0, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	var n int
+	if err := r.db.QueryRowContext(ctx, q, args...).Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// fuzzy reports whether f is a fuzzy search that pg_trgm can run.
+func (r *Repository) fuzzy(f ProvinceFilter) bool {
+	return f.Fuzzy && f.Search != "" && r.similarity > 0
+}
+
+// filterProvinces adds the FROM and WHERE clauses selecting the provinces
+// of f to b. The provinces table is aliased as p.
+func (r *Repository) filterProvinces(b sq.SelectBuilder, f ProvinceFilter) sq.SelectBuilder {
+	b = b.From(r.tables.provinces + " p")
+	if f.Tag != "" {
+		b = b.Join(r.tables.provinceTags + " t ON t.province_id = p.id").
+			Where(sq.Eq{"t.tag": f.Tag})
+	}
+	switch column, ok := searchLangs[f.Lang]; {
+	case r.fuzzy(f):
+		b = b.Where("similarity(p.name_english, ?) > ?", f.Search, r.similarity)
+	case f.Search != "" && ok:
+		b = b.Where(sq.ILike{"p." + column: "%" + escapeLike(f.Search) + "%"})
+	case f.Search != "":
+		pattern := "%" + escapeLike(f.Search) + "%"
+		b = b.Where(sq.Or{
+			sq.ILike{"p.name": pattern},
+			sq.ILike{"p.name_english": pattern},
+		})
+	}
+	if f.HasCities != nil {
+		where := "c.province_id = p.id"
+		if r.cityActive && !f.InactiveCities {
+			where += " AND c.active"
+		}
+		exists := "EXISTS (SELECT 1 FROM " + r.tables.cities + " c WHERE " + where + ")"
+		if !*f.HasCities {
+			exists = "NOT " + exists
+		}
+		b = b.Where(exists)
+	}
+	if len(f.Codes) > 0 {
+		b = b.Where(sq.Eq{"UPPER(p.code)": f.Codes})
+	}
+	switch f.Region {
+	case "":
+	case UnassignedRegion:
+		b = b.Where(sq.Eq{"p.region": nil})
+	default:
+		b = b.Where(sq.Eq{"p.region": f.Region})
+	}
+	return b
+}
+
+// escapeLike escapes the LIKE wildcards in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// GetProvincesByCodes lists the provinces matching any of the given
+// normalized codes, ignoring case.
+func (r *Repository) GetProvincesByCodes(ctx context.Context, codes []string) ([]Province, error) {
+	q, args, err := sq.Select(provinceColumns...).
+		From(r.tables.provinces).
+		Where(sq.Eq{"UPPER(code)": codes}).
+		OrderBy("id ASC").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	provinces := make([]Province, 0, len(codes))
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanProvince(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		provinces = append(provinces, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return provinces, nil
+}
+
+// GetProvincesByIDs lists the provinces matching any of the given ids.
+func (r *Repository) GetProvincesByIDs(ctx context.Context, ids []int) ([]Province, error) {
+	q, args, err := sq.Select(provinceColumns...).
+		From(r.tables.provinces).
+		Where(sq.Eq{"id": ids}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	provinces := make([]Province, 0, len(ids))
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanProvince(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		provinces = append(provinces, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return provinces, nil
+}
+
+func (r *Repository) GetProvinceByID(ctx context.Context, provinceID int) (Province, error) {
+	q, args, err := sq.Select(provinceColumns...).
+		From(r.tables.provinces).
+		Where("id = ?", provinceID).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return Province{}, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args, "province_id", provinceID)
+	row := r.db.QueryRowContext(ctx, q, args...)
+	p, err := scanProvince(row.Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Province{}, ErrUnknownProvince
+	}
+	if err != nil {
+		return Province{}, err
+	}
+	return p, err
+}
+
+// GetCentroids lists the centroids of the province boundaries, ordered by
+// id. Provinces without a boundary are left out.
+func (r *Repository) GetCentroids(ctx context.Context) ([]Centroid, error) {
+	q, args, err := sq.Select("id", "code", "name",
+		"ST_X(ST_Centroid(boundary))", "ST_Y(ST_Centroid(boundary))").
+		From(r.tables.provinces).
+		Where("boundary IS NOT NULL").
+		OrderBy("id ASC").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	centroids := make([]Centroid, 0)
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c Centroid
+		var code sql.NullString
+		if err := rows.Scan(&c.ID, &code, &c.Name, &c.Lng, &c.Lat); err != nil {
+			return nil, err
+		}
+		c.Code = code.String
+		centroids = append(centroids, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return centroids, nil
+}
+
+// GetNearestProvinces lists the limit provinces with a boundary whose
+// centroid is nearest to the point, the closest first. Distances are
+// computed on the spheroid, so they hold far from the equator too.
+func (r *Repository) GetNearestProvinces(ctx context.Context, lng, lat float64, limit int) ([]NearbyProvince, error) {
+	q, args, err := sq.Select("id", "code", "name", "name_english", "region").
+		Column("ST_Distance(ST_Centroid(boundary)::geography, ST_SetSRID(ST_MakePoint(?, ?), 4326)::geography) / 1000 AS distance_km", lng, lat).
+		From(r.tables.provinces).
+		Where("boundary IS NOT NULL").
+		OrderBy("distance_km ASC", "id ASC").
+		Limit(uint64(limit)).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	provinces := make([]NearbyProvince, 0, limit)
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p NearbyProvince
+		var code, region sql.NullString
+		if err := rows.Scan(&p.ID, &code, &p.Name, &p.NameEnglish, &region, &p.DistanceKm); err != nil {
+			return nil, err
+		}
+		p.Code, p.Region = code.String, region.String
+		provinces = append(provinces, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return provinces, nil
+}
+
+// GetProvincesWithin lists the provinces whose boundary intersects bbox,
+// ordered by id.
+func (r *Repository) GetProvincesWithin(ctx context.Context, bbox BBox) ([]Province, error) {
+	q, args, err := sq.Select(provinceColumns...).
+		From(r.tables.provinces).
+		Where("ST_Intersects(boundary, ST_MakeEnvelope(?, ?, ?, ?, 4326))",
+			bbox.MinLng, bbox.MinLat, bbox.MaxLng, bbox.MaxLat).
+		OrderBy("id ASC").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	provinces := make([]Province, 0)
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanProvince(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		provinces = append(provinces, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return provinces, nil
+}
+
+// FindProvince returns the province whose Lao or English name is name,
+// ignoring case, within region. An empty region matches every region and
+// UnassignedRegion matches provinces without one. It fails with
+// ErrAmbiguousProvince when several provinces match.
+func (r *Repository) FindProvince(ctx context.Context, name, region string) (Province, error) {
+	b := sq.Select(provinceColumns...).
+		From(r.tables.provinces).
+		Where("(lower(name) = lower(?) OR lower(name_english) = lower(?))", name, name)
+	switch region {
+	case "":
+	case UnassignedRegion:
+		b = b.Where(sq.Eq{"region": nil})
+	default:
+		b = b.Where(sq.Eq{"region": region})
+	}
+	// Two rows are enough to tell a unique match from an ambiguous one.
+	q, args, err := b.OrderBy("id ASC").
+		Limit(2).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return Province{}, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return Province{}, err
+	}
+	defer rows.Close()
+
+	var matches []Province
+	for rows.Next() {
+		p, err := scanProvince(rows.Scan)
+		if err != nil {
+			return Province{}, err
+		}
+		matches = append(matches, p)
+	}
+	if err := rows.Err(); err != nil {
+		return Province{}, err
+	}
+	switch len(matches) {
+	case 0:
+		return Province{}, ErrUnknownProvince
+	case 1:
+		return matches[0], nil
+	}
+	return Province{}, ErrAmbiguousProvince
+}
+
+// GetManifest lists the content hash of every province, ordered by id. The
+// hashes are computed by the database so that the rows are not sent over.
+func (r *Repository) GetManifest(ctx context.Context) ([]ManifestEntry, error) {
+	q, args, err := sq.Select("id", manifestHashSQL).
+		From(r.tables.provinces).
+		OrderBy("id ASC").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	manifest := make([]ManifestEntry, 0)
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m ManifestEntry
+		if err := rows.Scan(&m.ID, &m.Hash); err != nil {
+			return nil, err
+		}
+		manifest = append(manifest, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// GetProvincesByRegion lists every province ordered by region, then id.
+// Provinces without a region come last.
+func (r *Repository) GetProvincesByRegion(ctx context.Context) ([]Province, error) {
+	q, args, err := sq.Select(provinceColumns...).
+		From(r.tables.provinces).
+		OrderBy("region ASC NULLS LAST", "id ASC").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	provinces := make([]Province, 0)
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanProvince(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		provinces = append(provinces, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return provinces, nil
+}
+
+// DataVersion returns the version of the dataset, which every write moves
+// forward.
+func (r *Repository) DataVersion(ctx context.Context) (string, error) {
+	q, args, err := sq.Select("version").
+		From(r.tables.dataVersion).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return "", err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	var version int64
+	if err := r.db.QueryRowContext(ctx, q, args...).Scan(&version); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(version, 10), nil
+}
+
+// ProvinceExists reports whether a province with the given id exists.
+func (r *Repository) ProvinceExists(ctx context.Context, provinceID int) (bool, error) {
+	q, args, err := sq.Select("1").
+		From(r.tables.provinces).
+		Where(sq.Eq{"id": provinceID}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return false, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args, "province_id", provinceID)
+	var one int
+	err = r.db.QueryRowContext(ctx, q, args...).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Search runs a full-text query over province and city names and returns up
+// to limit results ranked by relevance.
+func (r *Repository) Search(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	const tsquery = `(SELECT plainto_tsquery('english', $1) || plainto_tsquery('simple', $1) AS query) q`
+	// Inactive cities are not searched.
+	var activeCity string
+	if r.cityActive {
+		activeCity = " AND active"
+	}
+	q := fmt.Sprintf(`SELECT '%s' AS type, id, name, COALESCE(name_english, ''), COALESCE(code, ''), 0, ts_rank(search_doc, q.query) AS rank
+FROM %s, %s
+WHERE search_doc @@ q.query
+UNION ALL
+SELECT '%s' AS type, id, name, COALESCE(name_english, ''), '', province_id, ts_rank(search_doc, q.query) AS rank
+FROM %s, %s
+WHERE search_doc @@ q.query%s
+ORDER BY rank DESC, type DESC, id
+LIMIT $2`,
+		SearchTypeProvince, r.tables.provinces, tsquery,
+		SearchTypeCity, r.tables.cities, tsquery, activeCity)
+	args := []any{query, limit}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+
+	results := make([]SearchResult, 0)
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sr SearchResult
+		if err := rows.Scan(&sr.Type, &sr.ID, &sr.Name, &sr.NameEnglish, &sr.Code, &sr.ProvinceID, &sr.Rank); err != nil {
+			return nil, err
+		}
+		results = append(results, sr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// GetProvinceByCode returns the province with the given code, ignoring
+// case. As codes are not unique, the first province by id is returned, as
+// by GetProvincesByCodes.
+func (r *Repository) GetProvinceByCode(ctx context.Context, code string) (Province, error) {
+	q, args, err := sq.Select(provinceColumns...).
+		From(r.tables.provinces).
+		Where("UPPER(code) = UPPER(?)", code).
+		OrderBy("id ASC").
+		Limit(1).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return Province{}, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	row := r.db.QueryRowContext(ctx, q, args...)
+	p, err := scanProvince(row.Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Province{}, ErrUnknownProvince
+	}
+	if err != nil {
+		return Province{}, err
+	}
+	return p, nil
+}
+
+// CreateProvince inserts a new province, or fails with ErrProvinceExists
+// when its id or code is in use.
+func (r *Repository) CreateProvince(ctx context.Context, p Province) error {
+	q, args, err := sq.Insert(r.tables.provinces).
+		Columns("id", "name", "name_english", "code", "region").
+		Values(p.ID, p.Name, sql.NullString{String: p.NameEnglish, Valid: p.NameEnglish != ""}, p.Code, sql.NullString{String: p.Region, Valid: p.Region != ""}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// As the codes are not unique in the table, the code is checked with
+	// the concurrent writes of provinces locked out, as imports do.
+	lock := "LOCK TABLE " + r.tables.provinces + " IN SHARE ROW EXCLUSIVE MODE"
+	logQuery(lock, nil)
+	if _, err := tx.ExecContext(ctx, lock); err != nil {
+		return err
+	}
+	used, err := r.codeInUse(ctx, tx, p.Code, 0)
+	if err != nil {
+		return err
+	}
+	if used {
+		return ErrProvinceExists
+	}
+
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	_, err = tx.ExecContext(ctx, q, args...)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrProvinceExists
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ImportProvinces inserts provinces in a transaction, skipping those whose
+// id or code is in use, and returns the set of ids inserted. As the codes
+// are not unique in the table, they are checked within the transaction,
+// which locks out concurrent writes of provinces until it ends.
+func (r *Repository) ImportProvinces(ctx context.Context, provinces []Province) (map[int]bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	lock := "LOCK TABLE " + r.tables.provinces + " IN SHARE ROW EXCLUSIVE MODE"
+	logQuery(lock, nil)
+	if _, err := tx.ExecContext(ctx, lock); err != nil {
+		return nil, err
+	}
+	used, err := r.usedCodes(ctx, tx, provinces)
+	if err != nil {
+		return nil, err
+	}
+
+	b := sq.Insert(r.tables.provinces).
+		Columns("id", "name", "name_english", "code", "region").
+		Suffix("ON CONFLICT DO NOTHING RETURNING id")
+	inserted := make(map[int]bool, len(provinces))
+	var n int
+	for _, p := range provinces {
+		code := strings.ToUpper(p.Code)
+		if used[code] {
+			continue
+		}
+		// Later provinces of the import may not reuse the code either.
+		used[code] = true
+		b = b.Values(p.ID, p.Name, sql.NullString{String: p.NameEnglish, Valid: p.NameEnglish != ""}, p.Code, sql.NullString{String: p.Region, Valid: p.Region != ""})
+		n++
+	}
+	if n == 0 {
+		return inserted, tx.Commit()
+	}
+	q, args, err := b.PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	rows, err := tx.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		inserted[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return inserted, tx.Commit()
+}
+
+// usedCodes returns the codes of provinces that are already stored,
+// upper-cased as codes are compared ignoring case.
+func (r *Repository) usedCodes(ctx context.Context, tx *sql.Tx, provinces []Province) (map[string]bool, error) {
+	codes := make([]string, len(provinces))
+	for i, p := range provinces {
+		codes[i] = strings.ToUpper(p.Code)
+	}
+	q, args, err := sq.Select("DISTINCT UPPER(code)").
+		From(r.tables.provinces).
+		Where(sq.Eq{"UPPER(code)": codes}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	rows, err := tx.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	used := make(map[string]bool, len(provinces))
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, err
+		}
+		used[code] = true
+	}
+	return used, rows.Err()
+}
+
+// UpdateCity sets the fields of a city that are set in fields and returns
+// the updated city, or ErrUnknownCity when there is no such city.
+func (r *Repository) UpdateCity(ctx context.Context, cityID int, fields CityUpdate) (City, error) {
+	b := sq.Update(r.tables.cities).
+		Where(sq.Eq{"id": cityID}).
+		Suffix("RETURNING id, name, name_english").
+		PlaceholderFormat(sq.Dollar)
+	if fields.Name != nil {
+		b = b.Set("name", *fields.Name)
+	}
+	if fields.NameEnglish != nil {
+		b = b.Set("name_english", *fields.NameEnglish)
+	}
+	q, args, err := b.ToSql()
+	if err != nil {
+		return City{}, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args, "city_id", cityID)
+	city, err := scanCity(r.db.QueryRowContext(ctx, q, args...).Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return City{}, ErrUnknownCity
+	}
+	return city, err
+}
+
+// UpdateProvince sets the fields of a province that are set in fields and
+// returns the updated province, or ErrUnknownProvince when there is no such
+// province and ErrProvinceExists when the new code is in use.
+func (r *Repository) UpdateProvince(ctx context.Context, provinceID int, fields ProvinceUpdate) (Province, error) {
+	b := sq.Update(r.tables.provinces).
+		Where(sq.Eq{"id": provinceID}).
+		Suffix("RETURNING " + strings.Join(provinceColumns, ", ")).
+		PlaceholderFormat(sq.Dollar)
+	if fields.Code != nil {
+		b = b.Set("code", *fields.Code)
+	}
+	if fields.Name != nil {
+		b = b.Set("name", *fields.Name)
+	}
+	if fields.NameEnglish != nil {
+		b = b.Set("name_english", sql.NullString{String: *fields.NameEnglish, Valid: *fields.NameEnglish != ""})
+	}
+	if fields.Region != nil {
+		b = b.Set("region", sql.NullString{String: *fields.Region, Valid: *fields.Region != ""})
+	}
+	q, args, err := b.ToSql()
+	if err != nil {
+		return Province{}, err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Province{}, err
+	}
+	defer tx.Rollback()
+
+	if fields.Code != nil {
+		// As the codes are not unique in the table, the code is checked
+		// with the concurrent writes of provinces locked out, as imports
+		// do.
+		lock := "LOCK TABLE " + r.tables.provinces + " IN SHARE ROW EXCLUSIVE MODE"
+		logQuery(lock, nil)
+		if _, err := tx.ExecContext(ctx, lock); err != nil {
+			return Province{}, err
+		}
+		used, err := r.codeInUse(ctx, tx, *fields.Code, provinceID)
+		if err != nil {
+			return Province{}, err
+		}
+		if used {
+			return Province{}, ErrProvinceExists
+		}
+	}
+
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args, "province_id", provinceID)
+	p, err := scanProvince(tx.QueryRowContext(ctx, q, args...).Scan)
+	var pqErr *pq.Error
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return Province{}, ErrUnknownProvince
+	case errors.As(err, &pqErr) && pqErr.Code == "23505":
+		return Province{}, ErrProvinceExists
+	case err != nil:
+		return Province{}, err
+	}
+	return p, tx.Commit()
+}
+
+// codeInUse reports whether a province other than provinceID has the
+// code, ignoring case as GetProvinceByCode does.
+func (r *Repository) codeInUse(ctx context.Context, tx *sql.Tx, code string, provinceID int) (bool, error) {
+	q, args, err := sq.Select("1").
+		From(r.tables.provinces).
+		Where("UPPER(code) = UPPER(?)", code).
+		Where(sq.NotEq{"id": provinceID}).
+		Limit(1).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return false, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	var one int
+	err = tx.QueryRowContext(ctx, q, args...).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetCities lists a page of the cities of a province in the given order,
+// leaving out the inactive ones unless inactive is set, in which case each
+// city tells whether it is active. The sort field must come from an
+// allowlist as it is interpolated into the query.
+func (r *Repository) GetCities(ctx context.Context, provinceID int, sort Sort, page Page, inactive bool) ([]City, error) {
+	b := sq.Select("id", "name", "name_english").
+		From(r.tables.cities).
+		Where(sq.Eq{"province_id": provinceID})
+	withActive := r.cityActive && inactive
+	if withActive {
+		b = b.Column("active")
+	}
+	q, args, err := page.apply(r.whereActive(b, "", inactive).OrderBy(orderBy("", sort)...)).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args, "province_id", provinceID)
+	cities := make([]City, 0)
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "42P01" {
+		return nil, fmt.Errorf("%w: %v", ErrCitiesUnavailable, err)
+	}
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		c, err := scanCity(rows.Scan)
+		scan := rows.Scan
+		var active bool
+		if withActive {
+			scan = func(dest ...any) error { return rows.Scan(append(dest, &active)...) }
+		}
+		c, err := scanCity(scan)
 		if err != nil {
 			return nil, err
 		}
+		if withActive {
+			c.Active = &active
+		}
+		cities = append(cities, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return cities, nil
+}
+
+// whereActive leaves out the inactive cities, the cities table being
+// aliased by alias, unless inactive is set.
+func (r *Repository) whereActive(b sq.SelectBuilder, alias string, inactive bool) sq.SelectBuilder {
+	if r.cityActive && !inactive {
+		return b.Where(alias + "active")
+	}
+	return b
+}
+
+// GetCityNames lists the names of the cities of a province in the given
+// order, loading only the name column.
+func (r *Repository) GetCityNames(ctx context.Context, provinceID int, sort Sort, inactive bool) ([]string, error) {
+	b := sq.Select("name").
+		From(r.tables.cities).
+		Where(sq.Eq{"province_id": provinceID})
+	q, args, err := r.whereActive(b, "", inactive).
+		OrderBy(orderBy("", sort)...).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args, "province_id", provinceID)
+	names := make([]string, 0)
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// GetCityIDs lists the ids of the cities of a province in ascending order.
+func (r *Repository) GetCityIDs(ctx context.Context, provinceID int, inactive bool) ([]int, error) {
+	b := sq.Select("id").
+		From(r.tables.cities).
+		Where(sq.Eq{"province_id": provinceID})
+	q, args, err := r.whereActive(b, "", inactive).
+		OrderBy("id ASC").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args, "province_id", provinceID)
+	ids := make([]int, 0)
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// GetAllCities lists a page of the cities of every province ordered by id,
+// joining the name and code of their province when withProvince is set.
+func (r *Repository) GetAllCities(ctx context.Context, page Page, withProvince, inactive bool) ([]CityListing, error) {
+	b := sq.Select("c.id", "c.name", "c.name_english", "c.province_id").
+		From(r.tables.cities + " c")
+	if withProvince {
+		b = b.Columns("p.name", "p.code").
+			Join(r.tables.provinces + " p ON p.id = c.province_id")
+	}
+	withActive := r.cityActive && inactive
+	if withActive {
+		b = b.Column("c.active")
+	}
+	q, args, err := page.apply(r.whereActive(b, "c.", inactive).OrderBy("c.id ASC")).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	cities := make([]CityListing, 0)
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			c                 CityListing
+			nameEnglish, code sql.NullString
+			provinceName      sql.NullString
+			active            bool
+		)
+		dest := []any{&c.ID, &c.Name, &nameEnglish, &c.ProvinceID}
+		if withProvince {
+			dest = append(dest, &provinceName, &code)
+		}
+		if withActive {
+			dest = append(dest, &active)
+			c.Active = &active
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		c.NameEnglish = nameEnglish.String
+		c.ProvinceName = provinceName.String
+		c.ProvinceCode = code.String
 		cities = append(cities, c)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 	return cities, nil
 }
 
+// CountAllCities counts the cities of every province.
+func (r *Repository) CountAllCities(ctx context.Context, inactive bool) (int, error) {
+	b := sq.Select("COUNT(*)").
+		From(r.tables.cities)
+	q, args, err := r.whereActive(b, "", inactive).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return 0, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	var n int
+	if err := r.db.QueryRowContext(ctx, q, args...).Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (r *Repository) StreamCities(ctx context.Context, provinceID int, inactive bool, fn func(City) error) error {
+	b := sq.Select("id", "name", "name_english").
+		From(r.tables.cities).
+		Where(sq.Eq{"province_id": provinceID})
+	withActive := r.cityActive && inactive
+	if withActive {
+		b = b.Column("active")
+	}
+	q, args, err := r.whereActive(b, "", inactive).
+		OrderBy(orderBy("", Sort{Field: "name"})...).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	logQuery(q, args)
+	// Only the query is timed as the rows are read as fast as the client
+	// takes them.
+	start := time.Now()
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	logSlowQuery(start, q, args, "province_id", provinceID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		scan := rows.Scan
+		var active bool
+		if withActive {
+			scan = func(dest ...any) error { return rows.Scan(append(dest, &active)...) }
+		}
+		c, err := scanCity(scan)
+		if err != nil {
+			return err
+		}
+		if withActive {
+			c.Active = &active
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (r *Repository) CountCities(ctx context.Context, provinceID int, inactive bool) (int, error) {
+	b := sq.Select("COUNT(*)").
+		From(r.tables.cities).
+		Where(sq.Eq{"province_id": provinceID})
+	q, args, err := r.whereActive(b, "", inactive).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return 0, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args, "province_id", provinceID)
+	var n int
+	if err := r.db.QueryRowContext(ctx, q, args...).Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// GetCitiesByProvinceIDs returns the cities of the given provinces keyed by
+// province id. Provinces without cities are absent from the result.
+func (r *Repository) GetCitiesByProvinceIDs(ctx context.Context, provinceIDs []int, inactive bool) (map[int][]City, error) {
+	b := sq.Select("province_id", "id", "name", "name_english").
+		From(r.tables.cities).
+		Where(sq.Eq{"province_id": provinceIDs})
+	withActive := r.cityActive && inactive
+	if withActive {
+		b = b.Column("active")
+	}
+	// Ordering by province keeps the cities of a province together for
+	// bucketCities.
+	q, args, err := r.whereActive(b, "", inactive).
+		OrderBy("province_id ASC", "name ASC", "id ASC").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	cities := make([]cityRow, 0)
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			row         cityRow
+			nameEnglish sql.NullString
+			active      bool
+		)
+		dest := []any{&row.provinceID, &row.city.ID, &row.city.Name, &nameEnglish}
+		if withActive {
+			dest = append(dest, &active)
+			row.city.Active = &active
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row.city.NameEnglish = nameEnglish.String
+		cities = append(cities, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return bucketCities(cities), nil
+}
+
+// cityRow is a city along with the id of its province.
+type cityRow struct {
+	provinceID int
+	city       City
+}
+
+// bucketCities groups cities by province, keeping their order. The cities
+// of a province must be contiguous. The buckets share one backing array,
+// so grouping allocates once and writes each province to the map once.
+func bucketCities(rows []cityRow) map[int][]City {
+	buckets := make(map[int][]City)
+	backing := make([]City, len(rows))
+	start := 0
+	for i, row := range rows {
+		backing[i] = row.city
+		if i+1 == len(rows) || rows[i+1].provinceID != row.provinceID {
+			// The capacity is capped so that appending to a bucket cannot
+			// overwrite the next one.
+			buckets[row.provinceID] = backing[start : i+1 : i+1]
+			start = i + 1
+		}
+	}
+	return buckets
+}
+
+// GetTags returns the tags of the given provinces keyed by province id.
+// Provinces without tags are absent from the result.
+func (r *Repository) GetTags(ctx context.Context, provinceIDs ...int) (map[int][]string, error) {
+	q, args, err := sq.Select("province_id", "tag").
+		From(r.tables.provinceTags).
+		Where(sq.Eq{"province_id": provinceIDs}).
+		OrderBy("tag").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	tags := make(map[int][]string)
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			provinceID int
+			tag        string
+		)
+		if err := rows.Scan(&provinceID, &tag); err != nil {
+			return nil, err
+		}
+		tags[provinceID] = append(tags[provinceID], tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// AddTag attaches a tag to a province; adding an existing tag is a no-op.
+func (r *Repository) AddTag(ctx context.Context, provinceID int, tag string) error {
+	q, args, err := sq.Insert(r.tables.provinceTags).
+		Columns("province_id", "tag").
+		Values(provinceID, tag).
+		Suffix("ON CONFLICT DO NOTHING").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args, "province_id", provinceID)
+	_, err = r.db.ExecContext(ctx, q, args...)
+	return err
+}
+
+// RemoveTag detaches a tag from a province; removing a missing tag is a no-op.
+func (r *Repository) RemoveTag(ctx context.Context, provinceID int, tag string) error {
+	q, args, err := sq.Delete(r.tables.provinceTags).
+		Where(sq.Eq{"province_id": provinceID, "tag": tag}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args, "province_id", provinceID)
+	_, err = r.db.ExecContext(ctx, q, args...)
+	return err
+}
+
+// DeleteProvinces deletes the given provinces in a single transaction.
+// Provinces that do not exist or that still have cities are reported in
+// the result instead of failing the whole batch. The foreign key of the
+// cities makes those inserted concurrently wait on the lock of their
+// province, so that none is inserted after the check.
+func (r *Repository) DeleteProvinces(ctx context.Context, ids []int) (*BulkDeleteResult, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	found, err := queryIDs(ctx, tx, sq.Select("id").
+		From(r.tables.provinces).
+		Where(sq.Eq{"id": ids}).
+		Suffix("FOR UPDATE"))
+	if err != nil {
+		return nil, err
+	}
+	withCities, err := queryIDs(ctx, tx, sq.Select("DISTINCT province_id").
+		From(r.tables.cities).
+		Where(sq.Eq{"province_id": ids}))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BulkDeleteResult{Missing: make([]int, 0), Conflicts: make([]int, 0)}
+	deletable := make([]int, 0, len(ids))
+	for _, id := range ids {
+		switch {
+		case !found[id]:
+			result.Missing = append(result.Missing, id)
+		case withCities[id]:
+			result.Conflicts = append(result.Conflicts, id)
+		default:
+			deletable = append(deletable, id)
+		}
+	}
+
+	if len(deletable) > 0 {
+		q, args, err := sq.Delete(r.tables.provinces).
+			Where(sq.Eq{"id": deletable}).
+			PlaceholderFormat(sq.Dollar).
+			ToSql()
+		if err != nil {
+			return nil, err
+		}
+		logQuery(q, args)
+		defer logSlowQuery(time.Now(), q, args)
+		res, err := tx.ExecContext(ctx, q, args...)
+		if err != nil {
+			return nil, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		result.Deleted = int(n)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// queryIDs runs a single-column integer query within tx and returns the set
+// of values found.
+func queryIDs(ctx context.Context, tx *sql.Tx, b sq.SelectBuilder) (map[int]bool, error) {
+	q, args, err := b.PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, err
+	}
+	logQuery(q, args)
+	defer logSlowQuery(time.Now(), q, args)
+	rows, err := tx.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// logSQL enables logging of every SQL statement run by the repository.
+var logSQL bool
+
+// logQuery logs a generated SQL statement and its arguments when SQL
+// logging is enabled.
+func logQuery(q string, args []any) {
+	if logSQL {
+		log.Printf("sql: %s %v", q, args)
+	}
+}
+
+// slowQuery is the duration above which a statement is logged as slow; 0
+// disables the slow query log.
+var slowQuery time.Duration
+
+// logSlowQuery logs a statement, its arguments and the time elapsed since
+// start when it is above slowQuery. attrs are key-value pairs giving
+// context, e.g. the province id.
+func logSlowQuery(start time.Time, q string, args []any, attrs ...any) {
+	elapsed := time.Since(start)
+	if slowQuery <= 0 || elapsed < slowQuery {
+		return
+	}
+	var extra strings.Builder
+	for i := 0; i+1 < len(attrs); i += 2 {
+		fmt.Fprintf(&extra, " %v=%v", attrs[i], attrs[i+1])
+	}
+	log.Printf("warning: slow sql (%s)%s: %s %v", elapsed, extra.String(), q, args)
+}
+
+// provinceColumns are the columns read by scanProvince, in order.
+var provinceColumns = []string{"id", "name", "name_english", "code", "region"}
+
+// scanProvince scans a province row. The nullable name_english, code and
+// region columns are read as empty strings when NULL.
 func scanProvince(scan func(...any) error) (p Province, _ error) {
-	return p, scan(&p.ID, &p.Name, &p.NameEnglish, &p.Code)
+	return scanProvinceColumns(scan, provinceColumns)
+}
+
+// scanProvinceColumns scans a province row holding the given columns,
+// which must all be province fields.
+func scanProvinceColumns(scan func(...any) error, columns []string) (p Province, _ error) {
+	var nameEnglish, code, region sql.NullString
+	dest := make([]any, len(columns))
+	for i, col := range columns {
+		switch col {
+		case "id":
+			dest[i] = &p.ID
+		case "name":
+			dest[i] = &p.Name
+		case "name_english":
+			dest[i] = &nameEnglish
+		case "code":
+			dest[i] = &code
+		case "region":
+			dest[i] = &region
+		default:
+			return p, fmt.Errorf("scan province: unknown column %q", col)
+		}
+	}
+	if err := scan(dest...); err != nil {
+		return p, err
+	}
+	p.NameEnglish = nameEnglish.String
+	p.Code = code.String
+	p.Region = region.String
+	return p, nil
 }
 
+// scanCity scans a city row. The nullable name_english column is read as
+// an empty string when NULL.
 func scanCity(scan func(...any) error) (c City, _ error) {
-	return c, scan(&c.ID, &c.Name, &c.NameEnglish)
+	var nameEnglish sql.NullString
+	if err := scan(&c.ID, &c.Name, &nameEnglish); err != nil {
+		return c, err
+	}
+	c.NameEnglish = nameEnglish.String
+	return c, nil
 }
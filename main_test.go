@@ -0,0 +1,914 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/labstack/echo/v4"
+)
+
+// testBackends returns the repositories the handler tests run against: the
+// snapshot, and the database of TEST_DB_URL when it is set, which must hold
+// the data of the migrations.
+func testBackends(t *testing.T) map[string]RepositoryIface {
+	t.Helper()
+	provinces, err := loadSnapshot("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := map[string]RepositoryIface{"memory": NewMemoryRepository(provinces)}
+	dsn := os.Getenv("TEST_DB_URL")
+	if dsn == "" {
+		return backends
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	repo := NewRepository(db, "", TableNames{
+		Provinces:    "tb_provinces",
+		Cities:       "tb_cities",
+		ProvinceTags: "tb_province_tags",
+	})
+	if err := repo.detectFeatures(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	backends["postgres"] = repo
+	return backends
+}
+
+// serve routes a request for target to handle registered on path,
+// rendering its error as the server would.
+func serve(h *handler, handle func(*handler, echo.Context) error, method, path, target string, body io.Reader) *httptest.ResponseRecorder {
+	e := echo.New()
+	e.HTTPErrorHandler = helper
+	e.Add(method, path, func(c echo.Context) error { return handle(h, c) })
+	req := httptest.NewRequest(method, target, body)
+	if body != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandlers(t *testing.T) {
+	tests := []struct {
+		name       string
+		handle     func(*handler, echo.Context) error
+		method     string
+		path       string
+		target     string
+		body       string
+		wantStatus int
+		want       []string
+	}{
+		{
+			name:       "province",
+			handle:     (*handler).GetByID,
+			path:       "/provinces/:id",
+			target:     "/provinces/1",
+			wantStatus: http.StatusOK,
+			want:       []string{`"id":1`, `"code":"HQ"`, `"name_english":"Vientiane capital"`},
+		},
+		{
+			name:       "province with cities",
+			handle:     (*handler).GetByID,
+			path:       "/provinces/:id",
+			target:     "/provinces/1?depth=1",
+			wantStatus: http.StatusOK,
+			want:       []string{`"cities":[`, `"name_english":"Chanthabuly"`},
+		},
+		{
+			name:       "unknown province",
+			handle:     (*handler).GetByID,
+			path:       "/provinces/:id",
+			target:     "/provinces/9999",
+			wantStatus: http.StatusNotFound,
+			want:       []string{`"error_code":"PROVINCE_NOT_FOUND"`},
+		},
+		{
+			name:       "invalid id",
+			handle:     (*handler).GetByID,
+			path:       "/provinces/:id",
+			target:     "/provinces/abc",
+			wantStatus: http.StatusBadRequest,
+			want:       []string{`"error_code":"INVALID_PARAM"`},
+		},
+		{
+			name:       "page of provinces",
+			handle:     (*handler).GetAll,
+			target:     "/provinces?limit=2",
+			wantStatus: http.StatusOK,
+			want:       []string{`"id":1`, `"id":2`},
+		},
+		{
+			name:       "search",
+			handle:     (*handler).GetAll,
+			target:     "/provinces?q=vien",
+			wantStatus: http.StatusOK,
+			want:       []string{`"code":"HQ"`, `"code":"VT"`},
+		},
+		{
+			name:       "city names",
+			handle:     (*handler).GetCities,
+			path:       "/provinces/:id/cities",
+			target:     "/provinces/1/cities?only=names",
+			wantStatus: http.StatusOK,
+			want:       []string{`"ຈັນທະບູລີ"`},
+		},
+		{
+			name:       "city count",
+			handle:     (*handler).CountCities,
+			path:       "/provinces/:id/cities/count",
+			target:     "/provinces/1/cities/count",
+			wantStatus: http.StatusOK,
+			want:       []string{`{"count":9}`},
+		},
+		{
+			name:       "batch",
+			handle:     (*handler).GetBatch,
+			method:     http.MethodPost,
+			target:     "/provinces/batch",
+			body:       `{"ids":[2,9999]}`,
+			wantStatus: http.StatusOK,
+			want:       []string{`"code":"PH"`, `"missing":[9999]`},
+		},
+		{
+			name:       "by codes",
+			handle:     (*handler).GetByCodes,
+			method:     http.MethodPost,
+			target:     "/provinces/by-codes",
+			body:       `{"codes":["lp","ZZ"]}`,
+			wantStatus: http.StatusOK,
+			want:       []string{`"lp":{`, `"name_english":"Louang Phabang"`, `"missing":["ZZ"]`},
+		},
+		{
+			name:       "search limit",
+			handle:     (*handler).Search,
+			target:     "/search?q=vien&limit=1",
+			wantStatus: http.StatusOK,
+			want:       []string{`"name_english":"Vientiane`},
+		},
+		{
+			name:       "search limit 0",
+			handle:     (*handler).Search,
+			target:     "/search?q=vien&limit=0",
+			wantStatus: http.StatusBadRequest,
+			want:       []string{`"error_code":"INVALID_PARAM"`, `between 1 and 100`},
+		},
+		{
+			name:       "search limit over max",
+			handle:     (*handler).Search,
+			target:     "/search?q=vien&limit=101",
+			wantStatus: http.StatusBadRequest,
+			want:       []string{`"error_code":"INVALID_PARAM"`, `between 1 and 100`},
+		},
+		{
+			name:       "resolve mixed-case code",
+			handle:     (*handler).Resolve,
+			target:     "/provinces/resolve?value=lP",
+			wantStatus: http.StatusOK,
+			want:       []string{`"id":6`, `"code":"LP"`, `"matched_by":"code"`},
+		},
+	}
+	for name, repo := range testBackends(t) {
+		h := NewHandler(NewService(repo, ServiceConfig{CodeWidth: 2}))
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				method := tt.method
+				if method == "" {
+					method = http.MethodGet
+				}
+				var body io.Reader
+				if tt.body != "" {
+					body = strings.NewReader(tt.body)
+				}
+				path := tt.path
+				if path == "" {
+					path = strings.SplitN(tt.target, "?", 2)[0]
+				}
+				rec := serve(h, tt.handle, method, path, tt.target, body)
+				if rec.Code != tt.wantStatus {
+					t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+				}
+				for _, want := range tt.want {
+					if !strings.Contains(rec.Body.String(), want) {
+						t.Errorf("body %s does not contain %s", rec.Body, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRowsErrorMidIteration(t *testing.T) {
+	errConn := errors.New("connection reset")
+	province := []driver.Value{int64(1), "ນະຄອນຫຼວງວຽງຈັນ", "Vientiane capital", "HQ", "Central"}
+	city := []driver.Value{int64(101), "ຈັນທະບູລີ", "Chanthabuly"}
+	tests := []struct {
+		name  string
+		res   fakeResult
+		query func(ctx context.Context, r *Repository) error
+	}{
+		{
+			name: "provinces",
+			res:  fakeResult{columns: provinceColumns, rows: [][]driver.Value{province}, err: errConn},
+			query: func(ctx context.Context, r *Repository) error {
+				_, err := r.GetProvinces(ctx, ProvinceFilter{})
+				return err
+			},
+		},
+		{
+			name: "cities",
+			res:  fakeResult{columns: []string{"id", "name", "name_english"}, rows: [][]driver.Value{city}, err: errConn},
+			query: func(ctx context.Context, r *Repository) error {
+				_, err := r.GetCities(ctx, 1, Sort{Field: "name"}, Page{}, false)
+				return err
+			},
+		},
+		{
+			name: "cities by province",
+			res: fakeResult{
+				columns: []string{"province_id", "id", "name", "name_english"},
+				rows:    [][]driver.Value{append([]driver.Value{int64(1)}, city...)},
+				err:     errConn,
+			},
+			query: func(ctx context.Context, r *Repository) error {
+				_, err := r.GetCitiesByProvinceIDs(ctx, []int{1}, false)
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFakeRepository(t, tt.res)
+			if err := tt.query(context.Background(), r); !errors.Is(err, errConn) {
+				t.Errorf("got %v, want %v", err, errConn)
+			}
+		})
+	}
+}
+
+func TestScanNullEnglishName(t *testing.T) {
+	r := newFakeRepository(t, fakeResult{
+		columns: provinceColumns,
+		rows:    [][]driver.Value{{int64(1), "ນະຄອນຫຼວງວຽງຈັນ", nil, nil, nil}},
+	})
+	p, err := r.GetProvinceByID(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.NameEnglish != "" || p.Code != "" || p.Region != "" {
+		t.Errorf("got %+v, want empty name_english, code and region", p)
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "name_english") {
+		t.Errorf("got %s, want name_english omitted", b)
+	}
+
+	r = newFakeRepository(t, fakeResult{
+		columns: []string{"id", "name", "name_english"},
+		rows:    [][]driver.Value{{int64(101), "ຈັນທະບູລີ", nil}},
+	})
+	cities, err := r.GetCities(context.Background(), 1, Sort{Field: "name"}, Page{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cities) != 1 || cities[0].NameEnglish != "" {
+		t.Errorf("got %+v, want one city without an English name", cities)
+	}
+}
+
+func TestQueryParam(t *testing.T) {
+	tests := []struct {
+		target  string
+		want    string
+		wantErr error
+	}{
+		{target: "/provinces", want: ""},
+		{target: "/provinces?limit=10", want: "10"},
+		{target: "/provinces?limit=", want: ""},
+		{target: "/provinces?limit=10&limit=20", wantErr: ErrDuplicateParam},
+		{target: "/provinces?limit=10&limit=10", wantErr: ErrDuplicateParam},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, tt.target, nil), httptest.NewRecorder())
+			got, err := queryParam(c, "limit")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	h := NewHandler(NewService(NewMemoryRepository(nil), ServiceConfig{}))
+	rec := serve(h, (*handler).GetAll, http.MethodGet, "/provinces", "/provinces?limit=10&limit=20", nil)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"error_code":"DUPLICATE_PARAM"`) {
+		t.Errorf("got %d %s, want 400 DUPLICATE_PARAM", rec.Code, rec.Body)
+	}
+}
+
+func TestIntParamBounds(t *testing.T) {
+	tests := []struct {
+		v       string
+		want    int
+		wantErr error
+	}{
+		{v: "2147483647", want: math.MaxInt32},
+		{v: "2147483648", wantErr: ErrParamOutOfRange},
+		{v: "-2147483648", want: math.MinInt32},
+		{v: "-2147483649", wantErr: ErrParamOutOfRange},
+		{v: "99999999999999999999", wantErr: ErrInvalidParamInt},
+		{v: "", wantErr: ErrMissingParam},
+	}
+	for _, tt := range tests {
+		got, err := intParam(tt.v)
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("intParam(%q) = %d, %v, want %d, %v", tt.v, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestPageParamsBounds(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    Page
+		wantErr error
+	}{
+		{query: "", want: Page{}},
+		{query: "limit=0", want: Page{Limit: maxPageSize, Adjusted: true}},
+		{query: "limit=1", want: Page{Limit: 1}},
+		{query: "limit=100", want: Page{Limit: maxPageSize}},
+		{query: "limit=101", want: Page{Limit: maxPageSize, Adjusted: true}},
+		{query: "limit=-1", want: Page{Limit: maxPageSize, Adjusted: true}},
+		{query: "limit=10&offset=-5", want: Page{Limit: 10}},
+		{query: "limit=10&offset=10000", want: Page{Limit: 10, Offset: 10000}},
+		{query: "limit=10&offset=10001", wantErr: ErrOffsetTooLarge},
+		{query: "limit=2147483648", wantErr: ErrParamOutOfRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/provinces?"+tt.query, nil), httptest.NewRecorder())
+			got, err := pageParams(c)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryProvinceFilter(t *testing.T) {
+	yes, no := true, false
+	repo := NewMemoryRepository([]Province{
+		{ID: 1, Code: "VTE", Name: "ນະຄອນຫຼວງວຽງຈັນ", NameEnglish: "Vientiane Capital", Region: "Central", Tags: []string{"capital"}, Cities: []City{{ID: 1}}},
+		{ID: 2, Code: "VT", Name: "ແຂວງວຽງຈັນ", NameEnglish: "Vientiane", Region: "Central", Cities: []City{{ID: 2}}},
+		{ID: 3, Code: "LP", Name: "ຫຼວງພະບາງ", NameEnglish: "Luang Prabang", Region: "Northern", Tags: []string{"heritage"}, Cities: []City{{ID: 3}}},
+		{ID: 4, Code: "XS", Name: "ໄຊສົມບູນ", NameEnglish: "Xaisomboun", Tags: []string{"heritage"}},
+	})
+	tests := []struct {
+		name string
+		f    ProvinceFilter
+		want []int
+	}{
+		{name: "none", want: []int{1, 2, 3, 4}},
+		{name: "search", f: ProvinceFilter{Search: "VIENTIANE"}, want: []int{1, 2}},
+		{name: "search in lang", f: ProvinceFilter{Search: "vientiane", Lang: "lo"}, want: []int{}},
+		{name: "search and region", f: ProvinceFilter{Search: "vientiane", Region: "Central"}, want: []int{1, 2}},
+		{name: "search and tag", f: ProvinceFilter{Search: "vientiane", Tag: "capital"}, want: []int{1}},
+		{name: "region and tag", f: ProvinceFilter{Region: "Northern", Tag: "heritage"}, want: []int{3}},
+		{name: "unassigned region and tag", f: ProvinceFilter{Region: UnassignedRegion, Tag: "heritage"}, want: []int{4}},
+		{name: "tag without cities", f: ProvinceFilter{Tag: "heritage", HasCities: &no}, want: []int{4}},
+		{name: "region with cities", f: ProvinceFilter{Region: "Central", HasCities: &yes}, want: []int{1, 2}},
+		{name: "search, region, tag and cities", f: ProvinceFilter{Search: "luang", Region: "Northern", Tag: "heritage", HasCities: &yes}, want: []int{3}},
+		{name: "conflicting", f: ProvinceFilter{Search: "luang", Region: "Central"}, want: []int{}},
+		{name: "codes and region", f: ProvinceFilter{Codes: []string{"VT", "LP"}, Region: "Central"}, want: []int{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provinces, err := repo.GetProvinces(context.Background(), tt.f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]int, 0, len(provinces))
+			for _, p := range provinces {
+				got = append(got, p.ID)
+			}
+			if !equalInts(got, tt.want) {
+				t.Errorf("got provinces %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterProvincesSQL(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name       string
+		f          ProvinceFilter
+		cityActive bool
+		want       string
+		wantArgs   []any
+	}{
+		{
+			name: "none",
+			want: "SELECT p.id FROM tb_provinces p",
+		},
+		{
+			name:     "search and region",
+			f:        ProvinceFilter{Search: "100%", Region: "Central"},
+			want:     "SELECT p.id FROM tb_provinces p WHERE (p.name ILIKE $1 OR p.name_english ILIKE $2) AND p.region = $3",
+			wantArgs: []any{`%100\%%`, `%100\%%`, "Central"},
+		},
+		{
+			name:     "search in lang and unassigned region",
+			f:        ProvinceFilter{Search: "luang", Lang: "en", Region: UnassignedRegion},
+			want:     "SELECT p.id FROM tb_provinces p WHERE p.name_english ILIKE $1 AND p.region IS NULL",
+			wantArgs: []any{"%luang%"},
+		},
+		{
+			name:     "tag and has cities",
+			f:        ProvinceFilter{Tag: "heritage", HasCities: &yes},
+			want:     "SELECT p.id FROM tb_provinces p JOIN tb_province_tags t ON t.province_id = p.id WHERE t.tag = $1 AND EXISTS (SELECT 1 FROM tb_cities c WHERE c.province_id = p.id)",
+			wantArgs: []any{"heritage"},
+		},
+		{
+			name:       "without active cities",
+			f:          ProvinceFilter{HasCities: &no},
+			cityActive: true,
+			want:       "SELECT p.id FROM tb_provinces p WHERE NOT EXISTS (SELECT 1 FROM tb_cities c WHERE c.province_id = p.id AND c.active)",
+		},
+		{
+			name:       "with inactive cities",
+			f:          ProvinceFilter{HasCities: &yes, InactiveCities: true},
+			cityActive: true,
+			want:       "SELECT p.id FROM tb_provinces p WHERE EXISTS (SELECT 1 FROM tb_cities c WHERE c.province_id = p.id)",
+		},
+		{
+			name:     "search, tag, cities, codes and region",
+			f:        ProvinceFilter{Search: "vien", Tag: "capital", HasCities: &yes, Codes: []string{"VTE", "VT"}, Region: "Central"},
+			want:     "SELECT p.id FROM tb_provinces p JOIN tb_province_tags t ON t.province_id = p.id WHERE t.tag = $1 AND (p.name ILIKE $2 OR p.name_english ILIKE $3) AND EXISTS (SELECT 1 FROM tb_cities c WHERE c.province_id = p.id) AND UPPER(p.code) IN ($4,$5) AND p.region = $6",
+			wantArgs: []any{"capital", "%vien%", "%vien%", "VTE", "VT", "Central"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFakeRepository(t, fakeResult{})
+			r.cityActive = tt.cityActive
+			q, args, err := r.filterProvinces(sq.Select("p.id"), tt.f).PlaceholderFormat(sq.Dollar).ToSql()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if q != tt.want {
+				t.Errorf("got query\n%s\nwant\n%s", q, tt.want)
+			}
+			if len(args) != len(tt.wantArgs) {
+				t.Fatalf("got args %v, want %v", args, tt.wantArgs)
+			}
+			for i := range args {
+				if args[i] != tt.wantArgs[i] {
+					t.Errorf("got args %v, want %v", args, tt.wantArgs)
+					break
+				}
+			}
+		})
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestProvincesOrderedByID(t *testing.T) {
+	for name, repo := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			provinces, err := repo.GetProvinces(context.Background(), ProvinceFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(provinces) < 2 {
+				t.Fatalf("got %d provinces, want several", len(provinces))
+			}
+			for i := 1; i < len(provinces); i++ {
+				if provinces[i-1].ID >= provinces[i].ID {
+					t.Fatalf("province %d listed before %d", provinces[i-1].ID, provinces[i].ID)
+				}
+			}
+		})
+	}
+}
+
+func TestCitiesSortedInRequestedOrder(t *testing.T) {
+	tests := []struct {
+		sort Sort
+		less func(a, b City) bool
+	}{
+		{sort: Sort{Field: "id"}, less: func(a, b City) bool { return a.ID < b.ID }},
+		{sort: Sort{Field: "id", Desc: true}, less: func(a, b City) bool { return a.ID > b.ID }},
+		{sort: Sort{Field: "name"}, less: func(a, b City) bool { return a.Name < b.Name }},
+		{sort: Sort{Field: "name", Desc: true}, less: func(a, b City) bool { return a.Name > b.Name }},
+	}
+	for name, repo := range testBackends(t) {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.sort.String(), func(t *testing.T) {
+				cities, err := repo.GetCities(context.Background(), 13, tt.sort, Page{}, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(cities) < 2 {
+					t.Fatalf("got %d cities, want several", len(cities))
+				}
+				for i := 1; i < len(cities); i++ {
+					if !tt.less(cities[i-1], cities[i]) {
+						t.Fatalf("city %d (%s) listed before %d (%s)", cities[i-1].ID, cities[i-1].Name, cities[i].ID, cities[i].Name)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	tests := []struct {
+		after time.Duration
+		want  string
+	}{
+		{0, "1"},
+		{500 * time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+		{time.Minute, "60"},
+	}
+	for _, tt := range tests {
+		err := withRetryAfter(ErrServerBusy, tt.after).(*retryAfterError)
+		if got := err.seconds(); got != tt.want {
+			t.Errorf("seconds() for %v = %q, want %q", tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	maint := &maintenance{retryAfter: 90 * time.Second}
+	maint.Set(true)
+	entered, release := make(chan struct{}), make(chan struct{})
+	busy := concurrencyLimit(1, 10*time.Millisecond, func(echo.Context) bool { return false })
+
+	e := echo.New()
+	e.HTTPErrorHandler = helper
+	e.GET("/maintenance", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, maint.Middleware())
+	e.GET("/busy", func(c echo.Context) error {
+		close(entered)
+		<-release
+		return c.NoContent(http.StatusOK)
+	}, busy)
+
+	// Hold the only slot of /busy.
+	held := make(chan struct{})
+	go func() {
+		defer close(held)
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/busy", nil))
+	}()
+	defer func() {
+		close(release)
+		<-held
+	}()
+	<-entered
+
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/maintenance", 90},
+		{"/busy", 1},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: got status %d, want %d", tt.target, rec.Code, http.StatusServiceUnavailable)
+		}
+		v := rec.Header().Get("Retry-After")
+		if got, err := strconv.Atoi(v); err != nil || got != tt.want {
+			t.Errorf("%s: got Retry-After %q, want %d", tt.target, v, tt.want)
+		}
+	}
+}
+
+func TestGetProvinceByCodeIgnoresCase(t *testing.T) {
+	for name, repo := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, code := range []string{"LP", "lp", "Lp", "lP"} {
+				p, err := repo.GetProvinceByCode(context.Background(), code)
+				if err != nil {
+					t.Fatalf("GetProvinceByCode(%q): %v", code, err)
+				}
+				if p.ID != 6 || p.Code != "LP" {
+					t.Errorf("GetProvinceByCode(%q) = province %d with code %q, want 6 with LP", code, p.ID, p.Code)
+				}
+			}
+			if _, err := repo.GetProvinceByCode(context.Background(), "zz"); !errors.Is(err, ErrUnknownProvince) {
+				t.Errorf("GetProvinceByCode(%q): got %v, want ErrUnknownProvince", "zz", err)
+			}
+		})
+	}
+}
+
+// BenchmarkAssemble reads the cities of 80 provinces, 1000 in all, and
+// assembles the provinces with them, as the full hierarchy does.
+func BenchmarkAssemble(b *testing.B) {
+	const provinces, cities = 80, 1000
+	ids := make([]int, provinces)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	rows := make([][]driver.Value, cities)
+	for i := range rows {
+		// The rows are ordered by province, as the query returns them.
+		provinceID := int64(i*provinces/cities + 1)
+		rows[i] = []driver.Value{provinceID, int64(i + 1), "ເມືອງ " + strconv.Itoa(i), "City " + strconv.Itoa(i)}
+	}
+	r := newFakeRepository(b, fakeResult{columns: []string{"province_id", "id", "name", "name_english"}, rows: rows})
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		byProvince, err := r.GetCitiesByProvinceIDs(ctx, ids, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, id := range ids {
+			assemble(&Province{ID: id}, byProvince[id])
+		}
+	}
+}
+
+func TestOrderByBreaksTiesByID(t *testing.T) {
+	tests := []struct {
+		alias string
+		sorts []Sort
+		want  []string
+	}{
+		{alias: "p.", want: []string{"p.id ASC"}},
+		{alias: "p.", sorts: []Sort{{Field: "name"}}, want: []string{"p.name ASC", "p.id ASC"}},
+		{alias: "p.", sorts: []Sort{{Field: "region"}, {Field: "name", Desc: true}}, want: []string{"p.region ASC", "p.name DESC", "p.id ASC"}},
+		{sorts: []Sort{{Field: "id", Desc: true}}, want: []string{"id DESC"}},
+		{sorts: []Sort{{Field: "id"}, {Field: "name"}}, want: []string{"id ASC"}},
+	}
+	for _, tt := range tests {
+		if got := orderBy(tt.alias, tt.sorts...); strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+			t.Errorf("orderBy(%q, %v) = %v, want %v", tt.alias, tt.sorts, got, tt.want)
+		}
+	}
+}
+
+func TestEqualSortKeysPageStably(t *testing.T) {
+	repo := NewMemoryRepository([]Province{
+		{ID: 7, Code: "B", Name: "Same", Cities: []City{{ID: 30, Name: "Same"}, {ID: 10, Name: "Same"}, {ID: 20, Name: "Same"}}},
+		{ID: 3, Code: "A", Name: "Same"},
+		{ID: 5, Code: "C", Name: "Same"},
+	})
+	ctx := context.Background()
+	for _, desc := range []bool{false, true} {
+		var provinces, cities []int
+		for offset := 0; offset < 3; offset++ {
+			page := Page{Limit: 1, Offset: offset}
+			ps, err := repo.GetProvinces(ctx, ProvinceFilter{Sort: []Sort{{Field: "name", Desc: desc}}, Page: page})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cs, err := repo.GetCities(ctx, 7, Sort{Field: "name", Desc: desc}, page, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ps) != 1 || len(cs) != 1 {
+				t.Fatalf("got %d provinces and %d cities at offset %d, want 1 each", len(ps), len(cs), offset)
+			}
+			provinces = append(provinces, ps[0].ID)
+			cities = append(cities, cs[0].ID)
+		}
+		// Ties are broken by ascending id in either order.
+		if !equalInts(provinces, []int{3, 5, 7}) {
+			t.Errorf("desc=%t: got provinces %v, want [3 5 7]", desc, provinces)
+		}
+		if !equalInts(cities, []int{10, 20, 30}) {
+			t.Errorf("desc=%t: got cities %v, want [10 20 30]", desc, cities)
+		}
+	}
+}
+
+func TestCompressReturnsHandledError(t *testing.T) {
+	var logged error
+	e := echo.New()
+	e.HTTPErrorHandler = helper
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			logged = next(c)
+			return logged
+		}
+	})
+	e.Use(compress(10))
+	rec := httptest.NewRecorder()
+	e.GET("/provinces/:id", func(c echo.Context) error {
+		u, ok := c.Response().Writer.(interface{ Unwrap() http.ResponseWriter })
+		if !ok || u.Unwrap() != rec {
+			t.Error("the compressing writer does not unwrap to the response writer")
+		}
+		return ErrUnknownProvince
+	})
+	req := httptest.NewRequest(http.MethodGet, "/provinces/9999", nil)
+	req.Header.Set(echo.HeaderAcceptEncoding, "gzip")
+	e.ServeHTTP(rec, req)
+
+	if !errors.Is(logged, ErrUnknownProvince) {
+		t.Errorf("got error %v, want ErrUnknownProvince", logged)
+	}
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The error response is written once.
+	if n := strings.Count(string(body), "PROVINCE_NOT_FOUND"); n != 1 {
+		t.Errorf("got %d error responses in %q, want 1", n, body)
+	}
+}
+
+func TestImportStreamsProgress(t *testing.T) {
+	const rows = 3000
+	repo := NewMemoryRepository(nil)
+	h := NewHandler(NewService(repo, ServiceConfig{ImportBatchSize: 10, ImportMaxErrors: 100}))
+	e := echo.New()
+	e.HTTPErrorHandler = helper
+	e.Use(compress(1024))
+	e.POST("/provinces/import", h.Import)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	// The body is streamed, so that the import reads it while the progress
+	// is being written.
+	pr, pw := io.Pipe()
+	go func() {
+		enc := json.NewEncoder(pw)
+		for i := 1; i <= rows; i++ {
+			if err := enc.Encode(ProvinceInput{ID: i, Code: "C" + strconv.Itoa(i), Name: "Province " + strconv.Itoa(i)}); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/provinces/import", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client asks for gzip and decompresses the progress itself.
+	req.Header.Set(echo.HeaderContentType, ndjsonContentType)
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	if !res.Uncompressed {
+		t.Error("the progress was not compressed")
+	}
+
+	var last ImportProgress
+	lines := 0
+	for dec := json.NewDecoder(res.Body); ; lines++ {
+		var p ImportProgress
+		if err := dec.Decode(&p); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		last = p
+	}
+	if !last.Done || last.Aborted != "" || last.Processed != rows || last.Inserted != rows {
+		t.Errorf("got final progress %+v, want %d rows inserted", last, rows)
+	}
+	if want := rows/10 + 1; lines != want {
+		t.Errorf("got %d progress lines, want %d", lines, want)
+	}
+	if n, err := repo.CountProvinces(context.Background(), ProvinceFilter{}); err != nil || n != rows {
+		t.Errorf("got %d provinces, %v, want %d", n, err, rows)
+	}
+}
+
+func TestGetProvinceByCodeFirstByID(t *testing.T) {
+	// The seed data has VT on provinces 10 and 13, and SL on 8 and 18.
+	want := map[string]int{"VT": 10, "sl": 8}
+	for name, repo := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			for code, id := range want {
+				p, err := repo.GetProvinceByCode(context.Background(), code)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p.ID != id {
+					t.Errorf("GetProvinceByCode(%q) = province %d, want %d", code, p.ID, id)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateProvinceCodeOnce(t *testing.T) {
+	for name, repo := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			s := NewService(repo, ServiceConfig{})
+			const n = 10
+			ids := make([]int, n)
+			for i := range ids {
+				ids[i] = 9000 + i
+			}
+			t.Cleanup(func() { repo.DeleteProvinces(context.Background(), ids) })
+			errs := make(chan error, n)
+			for _, id := range ids {
+				go func(id int) {
+					_, err := s.CreateProvince(context.Background(), Province{ID: id, Code: "ZQ", Name: "Province " + strconv.Itoa(id)})
+					errs <- err
+				}(id)
+			}
+			created := 0
+			for i := 0; i < n; i++ {
+				var verrs ValidationErrors
+				switch err := <-errs; {
+				case err == nil:
+					created++
+				case errors.Is(err, ErrProvinceExists), errors.As(err, &verrs):
+				default:
+					t.Fatal(err)
+				}
+			}
+			if created != 1 {
+				t.Errorf("created %d provinces with the same code, want 1", created)
+			}
+		})
+	}
+}
+
+func TestBatchSizeAfterDedup(t *testing.T) {
+	ids := make([]int, maxBatchSize+1)
+	codes := make([]string, maxBatchSize+1)
+	for i := range ids {
+		ids[i], codes[i] = 1, "LP"
+	}
+	if got, err := validateIDs(ids); err != nil || len(got) != 1 {
+		t.Errorf("validateIDs of repeated ids = %v, %v, want [1]", got, err)
+	}
+	if got, err := validateCodes(codes); err != nil || len(got) != 1 {
+		t.Errorf("validateCodes of repeated codes = %v, %v, want [LP]", got, err)
+	}
+
+	for i := range ids {
+		ids[i], codes[i] = i+1, strconv.Itoa(i+1)
+	}
+	if _, err := validateIDs(ids); !errors.Is(err, ErrBatchTooLarge) {
+		t.Errorf("validateIDs of %d ids: got %v, want ErrBatchTooLarge", len(ids), err)
+	}
+	if _, err := validateCodes(codes); !errors.Is(err, ErrBatchTooLarge) {
+		t.Errorf("validateCodes of %d codes: got %v, want ErrBatchTooLarge", len(codes), err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ManifestEntry is the content hash of a province. A client keeping a
+// copy of the provinces compares the hashes with those of its copy and
+// fetches the changed provinces with POST /provinces/batch.
+type ManifestEntry struct {
+	ID   int    `json:"id"`
+	Hash string `json:"hash"`
+}
+
+// manifestHashSQL is the content hash of a province row: the md5 of its
+// columns joined by the unit separator, NULL read as empty. provinceHash
+// computes the same hash in Go.
+const manifestHashSQL = "md5(concat_ws(chr(31), id, coalesce(code, ''), name, " +
+	"coalesce(name_english, ''), coalesce(region, '')))"
+
+// provinceHash returns the content hash of p, matching manifestHashSQL.
+func provinceHash(p Province) string {
+	sum := md5.Sum([]byte(strings.Join([]string{
+		strconv.Itoa(p.ID), p.Code, p.Name, p.NameEnglish, p.Region,
+	}, "\x1f")))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetManifest lists the content hash of every province, ordered by id.
+func (s *Service) GetManifest(ctx context.Context) ([]ManifestEntry, error) {
+	return s.repo.GetManifest(ctx)
+}
+
+// Manifest lists the content hash of every province.
+func (h *handler) Manifest(c echo.Context) error {
+	manifest, err := h.service.GetManifest(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, manifest)
+}
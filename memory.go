@@ -0,0 +1,673 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// embeddedSnapshot is the dataset bundled with the binary.
+//
+//go:embed snapshot.json
+var embeddedSnapshot []byte
+
+// snapshot is a JSON copy of the dataset: every province with its cities
+// and tags.
+type snapshot struct {
+	Provinces []Province `json:"provinces"`
+}
+
+// loadSnapshot reads the snapshot file at path, or the embedded snapshot
+// when path is empty.
+func loadSnapshot(path string) ([]Province, error) {
+	data := embeddedSnapshot
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		data = b
+	}
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return s.Provinces, nil
+}
+
+// MemoryRepository holds the dataset in memory. It serves the snapshot
+// while the database is down, and the whole API with STORAGE=memory.
+type MemoryRepository struct {
+	mu        sync.RWMutex
+	provinces []Province
+
+	// version counts the writes, like the database's tb_data_version.
+	version int64
+}
+
+// NewMemoryRepository creates a repository holding provinces, each with
+// its cities and tags.
+func NewMemoryRepository(provinces []Province) *MemoryRepository {
+	sorted := make([]Province, len(provinces))
+	copy(sorted, provinces)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	return &MemoryRepository{provinces: sorted}
+}
+
+// bare returns p without its cities and tags, as the repository methods
+// return them.
+func bare(p Province) Province {
+	p.Cities = nil
+	p.Tags = nil
+	return p
+}
+
+// index returns the position of a province in r.provinces, or -1.
+func (r *MemoryRepository) index(provinceID int) int {
+	i := sort.Search(len(r.provinces), func(i int) bool { return r.provinces[i].ID >= provinceID })
+	if i < len(r.provinces) && r.provinces[i].ID == provinceID {
+		return i
+	}
+	return -1
+}
+
+func (r *MemoryRepository) find(provinceID int) (Province, bool) {
+	if i := r.index(provinceID); i >= 0 {
+		return r.provinces[i], true
+	}
+	return Province{}, false
+}
+
+// filter returns the provinces selected by f, ignoring its page. Fuzzy
+// searches match substrings, as they do without pg_trgm.
+func (r *MemoryRepository) filter(f ProvinceFilter) []Province {
+	search := strings.ToLower(f.Search)
+	codes := make(map[string]bool, len(f.Codes))
+	for _, code := range f.Codes {
+		codes[code] = true
+	}
+
+	provinces := make([]Province, 0, len(r.provinces))
+	for _, p := range r.provinces {
+		switch {
+		case f.Tag != "" && !hasTag(p, f.Tag):
+		case search != "" && !matchesSearch(p, search, f.Lang):
+		case f.HasCities != nil && *f.HasCities != (len(p.Cities) > 0):
+		case len(codes) > 0 && !codes[strings.ToUpper(p.Code)]:
+		case f.Region == UnassignedRegion && p.Region != "":
+		case f.Region != "" && f.Region != UnassignedRegion && p.Region != f.Region:
+		default:
+			provinces = append(provinces, bare(p))
+		}
+	}
+	if len(f.Sort) > 0 {
+		sortProvinces(provinces, f.Sort)
+	}
+	return provinces
+}
+
+// matchesSearch reports whether a name of p in lang, or either name without
+// a lang, contains the lower-case search.
+func matchesSearch(p Province, search, lang string) bool {
+	names := map[string]string{"name": p.Name, "name_english": p.NameEnglish}
+	if column, ok := searchLangs[lang]; ok {
+		return strings.Contains(strings.ToLower(names[column]), search)
+	}
+	return strings.Contains(strings.ToLower(p.Name), search) ||
+		strings.Contains(strings.ToLower(p.NameEnglish), search)
+}
+
+// sortProvinces sorts provinces in place, mirroring the ORDER BY of the
+// database.
+func sortProvinces(provinces []Province, sorts []Sort) {
+	key := func(p Province, field string) string {
+		switch field {
+		case "name":
+			return p.Name
+		case "name_english":
+			return p.NameEnglish
+		case "code":
+			return p.Code
+		case "region":
+			return p.Region
+		}
+		return ""
+	}
+	// compare returns -1, 0 or 1 as a sorts before, with or after b by the
+	// field alone. A missing region sorts last like a NULL does.
+	compare := func(a, b Province, field string) int {
+		if field == "id" {
+			return cmpInt(a.ID, b.ID)
+		}
+		ka, kb := key(a, field), key(b, field)
+		if field == "region" && (ka == "") != (kb == "") {
+			if ka == "" {
+				return 1
+			}
+			return -1
+		}
+		return strings.Compare(ka, kb)
+	}
+	sort.SliceStable(provinces, func(i, j int) bool {
+		for _, s := range sorts {
+			c := compare(provinces[i], provinces[j], s.Field)
+			if s.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return provinces[i].ID < provinces[j].ID
+	})
+}
+
+// cmpInt returns -1, 0 or 1 as a is less than, equal to or greater than b.
+func cmpInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func hasTag(p Province, tag string) bool {
+	for _, t := range p.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// paginate returns the window of items selected by page.
+func paginate[T any](items []T, page Page) []T {
+	if page.Offset >= len(items) {
+		return make([]T, 0)
+	}
+	items = items[page.Offset:]
+	if page.Limit > 0 && page.Limit < len(items) {
+		items = items[:page.Limit]
+	}
+	return items
+}
+
+func (r *MemoryRepository) GetProvinces(ctx context.Context, f ProvinceFilter) ([]Province, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return paginate(r.filter(f), f.Page), nil
+}
+
+func (r *MemoryRepository) CountProvinces(ctx context.Context, f ProvinceFilter) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.filter(f)), nil
+}
+
+func (r *MemoryRepository) GetProvincesByIDs(ctx context.Context, ids []int) ([]Province, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	provinces := make([]Province, 0, len(ids))
+	for _, id := range ids {
+		if p, ok := r.find(id); ok {
+			provinces = append(provinces, bare(p))
+		}
+	}
+	return provinces, nil
+}
+
+func (r *MemoryRepository) GetProvincesByCodes(ctx context.Context, codes []string) ([]Province, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	wanted := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		wanted[code] = true
+	}
+	provinces := make([]Province, 0, len(codes))
+	for _, p := range r.provinces {
+		if p.Code != "" && wanted[strings.ToUpper(p.Code)] {
+			provinces = append(provinces, bare(p))
+		}
+	}
+	return provinces, nil
+}
+
+func (r *MemoryRepository) GetProvinceByID(ctx context.Context, provinceID int) (Province, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.find(provinceID)
+	if !ok {
+		return Province{}, ErrUnknownProvince
+	}
+	return bare(p), nil
+}
+
+// GetProvincesWithin finds nothing as the snapshot holds no boundaries.
+func (r *MemoryRepository) GetProvincesWithin(ctx context.Context, bbox BBox) ([]Province, error) {
+	return make([]Province, 0), nil
+}
+
+// GetCentroids finds nothing as the snapshot holds no boundaries.
+func (r *MemoryRepository) GetCentroids(ctx context.Context) ([]Centroid, error) {
+	return make([]Centroid, 0), nil
+}
+
+// GetNearestProvinces finds nothing as the snapshot holds no boundaries.
+func (r *MemoryRepository) GetNearestProvinces(ctx context.Context, lng, lat float64, limit int) ([]NearbyProvince, error) {
+	return make([]NearbyProvince, 0), nil
+}
+
+func (r *MemoryRepository) FindProvince(ctx context.Context, name, region string) (Province, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var matches []Province
+	for _, p := range r.provinces {
+		if !strings.EqualFold(p.Name, name) && !strings.EqualFold(p.NameEnglish, name) {
+			continue
+		}
+		switch {
+		case region == UnassignedRegion && p.Region != "":
+		case region != "" && region != UnassignedRegion && p.Region != region:
+		default:
+			matches = append(matches, bare(p))
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return Province{}, ErrUnknownProvince
+	case 1:
+		return matches[0], nil
+	}
+	return Province{}, ErrAmbiguousProvince
+}
+
+func (r *MemoryRepository) GetManifest(ctx context.Context) ([]ManifestEntry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	manifest := make([]ManifestEntry, len(r.provinces))
+	for i, p := range r.provinces {
+		manifest[i] = ManifestEntry{ID: p.ID, Hash: provinceHash(p)}
+	}
+	return manifest, nil
+}
+
+// GetProvincesByRegion lists every province ordered by region, then id,
+// with the provinces without a region last.
+func (r *MemoryRepository) GetProvincesByRegion(ctx context.Context) ([]Province, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	provinces := make([]Province, len(r.provinces))
+	for i, p := range r.provinces {
+		provinces[i] = bare(p)
+	}
+	sort.SliceStable(provinces, func(i, j int) bool {
+		a, b := provinces[i].Region, provinces[j].Region
+		if a == "" || b == "" {
+			return a != "" && b == ""
+		}
+		return a < b
+	})
+	return provinces, nil
+}
+
+// DataVersion returns a token that changes with every write. It is told
+// apart from the database versions so that switching between the snapshot
+// and the database changes it.
+func (r *MemoryRepository) DataVersion(ctx context.Context) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return "snapshot-" + strconv.FormatInt(r.version, 10), nil
+}
+
+func (r *MemoryRepository) ProvinceExists(ctx context.Context, provinceID int) (bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.find(provinceID)
+	return ok, nil
+}
+
+func (r *MemoryRepository) GetProvinceByCode(ctx context.Context, code string) (Province, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, p := range r.provinces {
+		if strings.EqualFold(p.Code, code) {
+			return bare(p), nil
+		}
+	}
+	return Province{}, ErrUnknownProvince
+}
+
+// Search matches the query as a case-insensitive substring of the names;
+// there is no stemming or ranking, every result has a rank of 1.
+func (r *MemoryRepository) Search(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	query = strings.ToLower(query)
+	matches := func(name, nameEnglish string) bool {
+		return strings.Contains(strings.ToLower(name), query) ||
+			strings.Contains(strings.ToLower(nameEnglish), query)
+	}
+
+	results := make([]SearchResult, 0)
+	for _, p := range r.provinces {
+		if matches(p.Name, p.NameEnglish) {
+			results = append(results, SearchResult{
+				Type:        SearchTypeProvince,
+				ID:          p.ID,
+				Name:        p.Name,
+				NameEnglish: p.NameEnglish,
+				Code:        p.Code,
+				Rank:        1,
+			})
+		}
+	}
+	for _, p := range r.provinces {
+		for _, c := range p.Cities {
+			if matches(c.Name, c.NameEnglish) {
+				results = append(results, SearchResult{
+					Type:        SearchTypeCity,
+					ID:          c.ID,
+					Name:        c.Name,
+					NameEnglish: c.NameEnglish,
+					ProvinceID:  p.ID,
+					Rank:        1,
+				})
+			}
+		}
+	}
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// GetCities lists the cities of a province; the snapshot has no inactive
+// cities.
+func (r *MemoryRepository) GetCities(ctx context.Context, provinceID int, s Sort, page Page, inactive bool) ([]City, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, _ := r.find(provinceID)
+	cities := make([]City, len(p.Cities))
+	copy(cities, p.Cities)
+	sortCities(cities, s)
+	return paginate(cities, page), nil
+}
+
+func (r *MemoryRepository) GetCityNames(ctx context.Context, provinceID int, s Sort, inactive bool) ([]string, error) {
+	cities, _ := r.GetCities(ctx, provinceID, s, Page{}, false)
+	names := make([]string, len(cities))
+	for i, c := range cities {
+		names[i] = c.Name
+	}
+	return names, nil
+}
+
+func (r *MemoryRepository) GetCityIDs(ctx context.Context, provinceID int, inactive bool) ([]int, error) {
+	cities, _ := r.GetCities(ctx, provinceID, Sort{Field: "id"}, Page{}, false)
+	ids := make([]int, len(cities))
+	for i, c := range cities {
+		ids[i] = c.ID
+	}
+	return ids, nil
+}
+
+func (r *MemoryRepository) GetAllCities(ctx context.Context, page Page, withProvince, inactive bool) ([]CityListing, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cities := make([]CityListing, 0)
+	for _, p := range r.provinces {
+		for _, c := range p.Cities {
+			l := CityListing{City: c, ProvinceID: p.ID}
+			if withProvince {
+				l.ProvinceName, l.ProvinceCode = p.Name, p.Code
+			}
+			cities = append(cities, l)
+		}
+	}
+	sort.Slice(cities, func(i, j int) bool { return cities[i].ID < cities[j].ID })
+	return paginate(cities, page), nil
+}
+
+func (r *MemoryRepository) CountAllCities(ctx context.Context, inactive bool) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	n := 0
+	for _, p := range r.provinces {
+		n += len(p.Cities)
+	}
+	return n, nil
+}
+
+// sortCities sorts cities in place, mirroring the ORDER BY of the database.
+func sortCities(cities []City, s Sort) {
+	sort.SliceStable(cities, func(i, j int) bool {
+		a, b := cities[i], cities[j]
+		if s.Field != "id" && a.Name != b.Name {
+			return (a.Name < b.Name) != s.Desc
+		}
+		// Ties are broken by ascending id, whatever the order.
+		if s.Field == "id" && s.Desc {
+			return a.ID > b.ID
+		}
+		return a.ID < b.ID
+	})
+}
+
+func (r *MemoryRepository) StreamCities(ctx context.Context, provinceID int, inactive bool, fn func(City) error) error {
+	cities, _ := r.GetCities(ctx, provinceID, Sort{Field: "name"}, Page{}, false)
+	for _, c := range cities {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) CountCities(ctx context.Context, provinceID int, inactive bool) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, _ := r.find(provinceID)
+	return len(p.Cities), nil
+}
+
+func (r *MemoryRepository) GetCitiesByProvinceIDs(ctx context.Context, provinceIDs []int, inactive bool) (map[int][]City, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cities := make(map[int][]City)
+	for _, id := range provinceIDs {
+		p, ok := r.find(id)
+		if !ok || len(p.Cities) == 0 {
+			continue
+		}
+		c := make([]City, len(p.Cities))
+		copy(c, p.Cities)
+		sortCities(c, Sort{Field: "name"})
+		cities[id] = c
+	}
+	return cities, nil
+}
+
+func (r *MemoryRepository) GetTags(ctx context.Context, provinceIDs ...int) (map[int][]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tags := make(map[int][]string)
+	for _, id := range provinceIDs {
+		p, ok := r.find(id)
+		if !ok || len(p.Tags) == 0 {
+			continue
+		}
+		t := make([]string, len(p.Tags))
+		copy(t, p.Tags)
+		sort.Strings(t)
+		tags[id] = t
+	}
+	return tags, nil
+}
+
+func (r *MemoryRepository) CreateProvince(ctx context.Context, p Province) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.find(p.ID); ok {
+		return ErrProvinceExists
+	}
+	for _, other := range r.provinces {
+		if strings.EqualFold(other.Code, p.Code) {
+			return ErrProvinceExists
+		}
+	}
+	r.version++
+	p = bare(p)
+	i := sort.Search(len(r.provinces), func(i int) bool { return r.provinces[i].ID >= p.ID })
+	r.provinces = append(r.provinces, Province{})
+	copy(r.provinces[i+1:], r.provinces[i:])
+	r.provinces[i] = p
+	return nil
+}
+
+func (r *MemoryRepository) ImportProvinces(ctx context.Context, provinces []Province) (map[int]bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Codes are compared ignoring case, as by GetProvinceByCode.
+	codes := make(map[string]bool, len(r.provinces))
+	for _, p := range r.provinces {
+		codes[strings.ToUpper(p.Code)] = true
+	}
+	inserted := make(map[int]bool, len(provinces))
+	for _, p := range provinces {
+		if _, ok := r.find(p.ID); ok || codes[strings.ToUpper(p.Code)] {
+			continue
+		}
+		p = bare(p)
+		i := sort.Search(len(r.provinces), func(i int) bool { return r.provinces[i].ID >= p.ID })
+		r.provinces = append(r.provinces, Province{})
+		copy(r.provinces[i+1:], r.provinces[i:])
+		r.provinces[i] = p
+		codes[strings.ToUpper(p.Code)] = true
+		inserted[p.ID] = true
+	}
+	if len(inserted) > 0 {
+		r.version++
+	}
+	return inserted, nil
+}
+
+func (r *MemoryRepository) AddTag(ctx context.Context, provinceID int, tag string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.version++
+	i := r.index(provinceID)
+	if i < 0 || hasTag(r.provinces[i], tag) {
+		return nil
+	}
+	// Copy on write as the tags may be shared with the loaded snapshot.
+	tags := make([]string, len(r.provinces[i].Tags), len(r.provinces[i].Tags)+1)
+	copy(tags, r.provinces[i].Tags)
+	r.provinces[i].Tags = append(tags, tag)
+	return nil
+}
+
+func (r *MemoryRepository) RemoveTag(ctx context.Context, provinceID int, tag string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.version++
+	i := r.index(provinceID)
+	if i < 0 {
+		return nil
+	}
+	tags := make([]string, 0, len(r.provinces[i].Tags))
+	for _, t := range r.provinces[i].Tags {
+		if t != tag {
+			tags = append(tags, t)
+		}
+	}
+	r.provinces[i].Tags = tags
+	return nil
+}
+
+func (r *MemoryRepository) UpdateCity(ctx context.Context, cityID int, fields CityUpdate) (City, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.provinces {
+		for j, c := range r.provinces[i].Cities {
+			if c.ID != cityID {
+				continue
+			}
+			if fields.Name != nil {
+				c.Name = *fields.Name
+			}
+			if fields.NameEnglish != nil {
+				c.NameEnglish = *fields.NameEnglish
+			}
+			r.version++
+			// Copy on write as the cities may be shared with the loaded snapshot.
+			cities := make([]City, len(r.provinces[i].Cities))
+			copy(cities, r.provinces[i].Cities)
+			cities[j] = c
+			r.provinces[i].Cities = cities
+			return c, nil
+		}
+	}
+	return City{}, ErrUnknownCity
+}
+
+func (r *MemoryRepository) UpdateProvince(ctx context.Context, provinceID int, fields ProvinceUpdate) (Province, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.index(provinceID)
+	if i < 0 {
+		return Province{}, ErrUnknownProvince
+	}
+	p := r.provinces[i]
+	if fields.Code != nil {
+		for _, other := range r.provinces {
+			if other.ID != provinceID && strings.EqualFold(other.Code, *fields.Code) {
+				return Province{}, ErrProvinceExists
+			}
+		}
+		p.Code = *fields.Code
+	}
+	if fields.Name != nil {
+		p.Name = *fields.Name
+	}
+	if fields.NameEnglish != nil {
+		p.NameEnglish = *fields.NameEnglish
+	}
+	if fields.Region != nil {
+		p.Region = *fields.Region
+	}
+	r.version++
+	r.provinces[i] = p
+	return bare(p), nil
+}
+
+// DeleteProvinces deletes the provinces without cities, mirroring the
+// database.
+func (r *MemoryRepository) DeleteProvinces(ctx context.Context, ids []int) (*BulkDeleteResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.version++
+	result := &BulkDeleteResult{Missing: make([]int, 0), Conflicts: make([]int, 0)}
+	for _, id := range ids {
+		i := r.index(id)
+		switch {
+		case i < 0:
+			result.Missing = append(result.Missing, id)
+		case len(r.provinces[i].Cities) > 0:
+			result.Conflicts = append(result.Conflicts, id)
+		default:
+			r.provinces = append(r.provinces[:i], r.provinces[i+1:]...)
+			result.Deleted++
+		}
+	}
+	return result, nil
+}
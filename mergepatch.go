@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// mergePatchContentType is the media type of JSON Merge Patch documents
+// (RFC 7386).
+const mergePatchContentType = "application/merge-patch+json"
+
+// maxPatchSize is the largest patch document read.
+const maxPatchSize = 64 << 10
+
+// ProvinceUpdate holds the fields of a province to update; nil fields are
+// left unchanged. An empty name_english or region is stored as NULL.
+type ProvinceUpdate struct {
+	Code        *string
+	Name        *string
+	NameEnglish *string
+	Region      *string
+}
+
+func (u ProvinceUpdate) empty() bool {
+	return u.Code == nil && u.Name == nil && u.NameEnglish == nil && u.Region == nil
+}
+
+// parseMergePatch reads a merge patch of a province. Keys that are absent
+// leave their field unchanged and null clears a nullable field, which a
+// struct cannot tell apart, so the document is read key by key. Unknown
+// keys and values of the wrong type are validation errors.
+func parseMergePatch(data []byte) (ProvinceUpdate, error) {
+	var u ProvinceUpdate
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil || doc == nil {
+		return u, echo.NewHTTPError(http.StatusBadRequest, "request body: must be a JSON object")
+	}
+	fields := map[string]struct {
+		dst      **string
+		nullable bool
+	}{
+		"code":         {&u.Code, false},
+		"name":         {&u.Name, false},
+		"name_english": {&u.NameEnglish, true},
+		"region":       {&u.Region, true},
+	}
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var verrs ValidationErrors
+	for _, key := range keys {
+		f, ok := fields[key]
+		if !ok {
+			verrs = append(verrs, FieldError{key, "is not a province field"})
+			continue
+		}
+		raw := doc[key]
+		if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+			if !f.nullable {
+				verrs = append(verrs, FieldError{key, "cannot be null"})
+				continue
+			}
+			*f.dst = new(string)
+			continue
+		}
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			verrs = append(verrs, FieldError{key, "must be a string"})
+			continue
+		}
+		*f.dst = &v
+	}
+	if len(verrs) > 0 {
+		return u, verrs
+	}
+	return u, nil
+}
+
+// normalizeProvinceUpdate trims the fields of an update like those of a
+// new province.
+func normalizeProvinceUpdate(u ProvinceUpdate) ProvinceUpdate {
+	trim := func(s *string, normalize func(string) string) *string {
+		if s == nil {
+			return nil
+		}
+		v := normalize(*s)
+		return &v
+	}
+	u.Code = trim(u.Code, normalizeCode)
+	u.Name = trim(u.Name, strings.TrimSpace)
+	u.NameEnglish = trim(u.NameEnglish, strings.TrimSpace)
+	u.Region = trim(u.Region, strings.TrimSpace)
+	return u
+}
+
+// validateProvinceUpdate checks the format of the fields that are set.
+func validateProvinceUpdate(u ProvinceUpdate) ValidationErrors {
+	var verrs ValidationErrors
+	if u.Code != nil {
+		if n := utf8.RuneCountInString(*u.Code); n == 0 || n > 5 {
+			verrs = append(verrs, FieldError{"code", "must be 1-5 characters"})
+		}
+	}
+	if u.Name != nil {
+		if n := utf8.RuneCountInString(*u.Name); n == 0 || n > 100 {
+			verrs = append(verrs, FieldError{"name", "must be 1-100 characters"})
+		}
+	}
+	if u.NameEnglish != nil && utf8.RuneCountInString(*u.NameEnglish) > 100 {
+		verrs = append(verrs, FieldError{"name_english", "must be at most 100 characters"})
+	}
+	if u.Region != nil && utf8.RuneCountInString(*u.Region) > 50 {
+		verrs = append(verrs, FieldError{"region", "must be at most 50 characters"})
+	}
+	return verrs
+}
+
+// UpdateProvince applies a JSON Merge Patch to a province. A plain JSON
+// body is read as a merge patch too.
+func (h *handler) UpdateProvince(c echo.Context) error {
+	id, err := intParam(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if mediaType != mergePatchContentType && mediaType != echo.MIMEApplicationJSON {
+		return echo.ErrUnsupportedMediaType
+	}
+	data, err := io.ReadAll(io.LimitReader(c.Request().Body, maxPatchSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxPatchSize {
+		return echo.ErrStatusRequestEntityTooLarge
+	}
+	fields, err := parseMergePatch(data)
+	if err != nil {
+		return err
+	}
+	p, err := h.service.UpdateProvince(c.Request().Context(), id, fields)
+	if err != nil {
+		return err
+	}
+	return writeResult(c, http.StatusOK, c.Request().URL.Path, p)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// metricsContentType is the content type of the Prometheus text format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metric is a single sample in the Prometheus text format.
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	value float64
+}
+
+// cacheMetrics returns the cache statistics as metrics.
+func cacheMetrics(s CacheStats) []metric {
+	return []metric{
+		{"province_cache_hits_total", "Cache lookups served from the cache.", "counter", float64(s.Hits)},
+		{"province_cache_misses_total", "Cache lookups that went to the database.", "counter", float64(s.Misses)},
+		{"province_cache_evictions_total", "Cache entries dropped because they expired.", "counter", float64(s.Evictions)},
+		{"province_cache_entries", "Entries currently held by the cache.", "gauge", float64(s.Size)},
+	}
+}
+
+// hitRatio returns the share of lookups served from the cache, or 0 when
+// nothing was looked up yet.
+func (s CacheStats) hitRatio() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// writeMetrics writes metrics in the Prometheus text format.
+func writeMetrics(w io.Writer, metrics []metric) error {
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n",
+			m.name, m.help, m.name, m.kind, m.name, m.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// probePaths are the health and metrics routes that bypass request
+// limiting.
+var probePaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// skipProbes is a middleware.Skipper that skips the probe routes.
+func skipProbes(c echo.Context) bool {
+	return probePaths[c.Path()]
+}
+
+// skipPaths returns a middleware.Skipper that skips the requests to the
+// comma-separated paths, e.g. "/healthz,/metrics".
+func skipPaths(paths string) middleware.Skipper {
+	skip := make(map[string]bool)
+	for _, p := range strings.Split(paths, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			skip[p] = true
+		}
+	}
+	return func(c echo.Context) bool {
+		return skip[c.Request().URL.Path]
+	}
+}
+
+// streamPaths are the routes streaming their response, which must not be
+// buffered by the request timeout.
+var streamPaths = map[string]bool{
+	"/api/v1/provinces/:id/cities/stream": true,
+	"/api/v1/provinces/:id/cities.csv":    true,
+	"/api/v1/provinces/import":            true,
+}
+
+// skipStreams is a middleware.Skipper that skips the probe and streaming
+// routes.
+func skipStreams(c echo.Context) bool {
+	return skipProbes(c) || streamPaths[c.Path()]
+}
+
+// connKey is the context key of the connection of a request.
+type connKey struct{}
+
+// saveConn is an http.Server ConnContext keeping the connection in the
+// context of its requests, for connDeadlines.
+func saveConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// connDeadlines bounds the time spent reading the body of a request and
+// writing its response, as the server ReadTimeout and WriteTimeout would,
+// except on the routes skipped, which stream for as long as the client
+// keeps up. The deadlines are set on the connection, so only HTTP/1
+// requests are bounded; HTTP/2 ones are still bounded by the request
+// timeout. A zero timeout sets no deadline.
+func connDeadlines(read, write time.Duration, skipper middleware.Skipper) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			conn, ok := req.Context().Value(connKey{}).(net.Conn)
+			if !ok || req.ProtoMajor != 1 {
+				return next(c)
+			}
+			// Deadlines are reset on every request as the connection may
+			// have served a skipped one before.
+			var readDeadline, writeDeadline time.Time
+			if now := time.Now(); !skipper(c) {
+				if read > 0 {
+					readDeadline = now.Add(read)
+				}
+				if write > 0 {
+					writeDeadline = now.Add(write)
+				}
+			}
+			if err := conn.SetReadDeadline(readDeadline); err != nil {
+				return err
+			}
+			if err := conn.SetWriteDeadline(writeDeadline); err != nil {
+				return err
+			}
+			return next(c)
+		}
+	}
+}
+
+// requestTimeout bounds the time spent on a request. A request running past
+// timeout gets a 503 with the JSON error envelope, and its context is
+// canceled so that its database queries are canceled too.
+func requestTimeout(timeout time.Duration, skipper middleware.Skipper) echo.MiddlewareFunc {
+	body, _ := json.Marshal(errorResponse{
+		Code:      http.StatusServiceUnavailable,
+		ErrorCode: "TIMEOUT",
+		Message:   "request took too long",
+	})
+	timeoutMiddleware := middleware.TimeoutWithConfig(middleware.TimeoutConfig{
+		Skipper:      skipper,
+		Timeout:      timeout,
+		ErrorMessage: string(body),
+	})
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := timeoutMiddleware(next)
+		return func(c echo.Context) error {
+			if !skipper(c) {
+				res := c.Response()
+				w := res.Writer
+				res.Writer = timeoutWriter{w}
+				defer func() { res.Writer = w }()
+			}
+			return h(c)
+		}
+	}
+}
+
+// timeoutWriter marks the body http.TimeoutHandler writes on timeout as
+// JSON, as it is written without a Content-Type.
+type timeoutWriter struct {
+	http.ResponseWriter
+}
+
+func (w timeoutWriter) WriteHeader(code int) {
+	if code == http.StatusServiceUnavailable && w.Header().Get(echo.HeaderContentType) == "" {
+		w.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// jsonCharset adds charset=UTF-8 to the JSON responses that are sent
+// without a charset, such as the GeoJSON and NDJSON ones, as some clients
+// otherwise fall back to another charset and garble the multi-byte names.
+func jsonCharset() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			res := c.Response()
+			res.Before(func() {
+				mediaType, params, err := mime.ParseMediaType(res.Header().Get(echo.HeaderContentType))
+				if err != nil || params["charset"] != "" {
+					return
+				}
+				if mediaType == echo.MIMEApplicationJSON || mediaType == ndjsonContentType ||
+					strings.HasSuffix(mediaType, "+json") {
+					params["charset"] = "UTF-8"
+					res.Header().Set(echo.HeaderContentType, mime.FormatMediaType(mediaType, params))
+				}
+			})
+			return next(c)
+		}
+	}
+}
+
+// inFlight counts the requests being handled.
+type inFlight struct {
+	n int64
+}
+
+// Middleware counts the requests passing through it while they run.
+func (f *inFlight) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			atomic.AddInt64(&f.n, 1)
+			defer atomic.AddInt64(&f.n, -1)
+			return next(c)
+		}
+	}
+}
+
+// Count returns the number of requests being handled.
+func (f *inFlight) Count() int64 {
+	return atomic.LoadInt64(&f.n)
+}
+
+// ErrMaintenance is returned for API requests while the API is down for
+// maintenance.
+var ErrMaintenance = errors.New("service is down for maintenance")
+
+// maintenance is a switch taking the API offline, e.g. during a data
+// migration, while the process keeps running and answering probes.
+type maintenance struct {
+	on         int32
+	retryAfter time.Duration
+}
+
+// Set turns maintenance mode on or off.
+func (m *maintenance) Set(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&m.on, v)
+}
+
+// Enabled reports whether maintenance mode is on.
+func (m *maintenance) Enabled() bool {
+	return atomic.LoadInt32(&m.on) == 1
+}
+
+// Middleware rejects requests with ErrMaintenance while maintenance mode
+// is on.
+func (m *maintenance) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if m.Enabled() {
+				return withRetryAfter(ErrMaintenance, m.retryAfter)
+			}
+			return next(c)
+		}
+	}
+}
+
+// Toggle reports maintenance mode and, for a PUT with {"enabled": bool},
+// turns it on or off.
+func (m *maintenance) Toggle(c echo.Context) error {
+	if c.Request().Method == http.MethodPut {
+		var body struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+		if body.Enabled == nil {
+			return ValidationErrors{{"enabled", "is required"}}
+		}
+		m.Set(*body.Enabled)
+	}
+	return c.JSON(http.StatusOK, map[string]bool{"enabled": m.Enabled()})
+}
+
+// ErrServerBusy is returned when a request could not get a concurrency slot
+// in time.
+var ErrServerBusy = errors.New("server is busy, please retry later")
+
+// retryAfterError is an error that tells clients when to retry; the error
+// handler sends the delay in a Retry-After header.
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+// withRetryAfter attaches a retry delay to err.
+func withRetryAfter(err error, after time.Duration) error {
+	return &retryAfterError{err: err, after: after}
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// seconds returns the delay in whole seconds, rounded up to at least one
+// as Retry-After cannot express less.
+func (e *retryAfterError) seconds() string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(e.after.Seconds()))))
+}
+
+// concurrencyLimit bounds the number of requests handled at once. A request
+// waits up to wait for a free slot before failing with ErrServerBusy, and
+// is asked to retry after the same wait.
+func concurrencyLimit(max int, wait time.Duration, skipper middleware.Skipper) echo.MiddlewareFunc {
+	slots := make(chan struct{}, max)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if skipper(c) {
+				return next(c)
+			}
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+
+			select {
+			case slots <- struct{}{}:
+			case <-timer.C:
+				return withRetryAfter(ErrServerBusy, wait)
+			case <-c.Request().Context().Done():
+				return c.Request().Context().Err()
+			}
+			defer func() { <-slots }()
+			return next(c)
+		}
+	}
+}
+
+// adminAuth requires requests to carry "Authorization: Bearer <token>".
+// With an empty token every request is rejected.
+func adminAuth(token string) echo.MiddlewareFunc {
+	return middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+		Validator: func(key string, c echo.Context) (bool, error) {
+			if token == "" {
+				return false, nil
+			}
+			return subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1, nil
+		},
+		ErrorHandler: func(err error, c echo.Context) error {
+			return echo.ErrUnauthorized
+		},
+	})
+}
+
+// ErrUnknownParam is an error when a request carries a query param the
+// route does not support.
+var ErrUnknownParam = errors.New("param: not supported by this route")
+
+// globalParams are the query params every route accepts.
+var globalParams = []string{"pretty"}
+
+// queryAllowlist returns a function building a middleware that rejects the
+// query params missing from the given names. When strict is false the
+// middleware lets every param through.
+func queryAllowlist(strict bool) func(names ...string) echo.MiddlewareFunc {
+	return func(names ...string) echo.MiddlewareFunc {
+		allowed := make(map[string]bool, len(names)+len(globalParams))
+		for _, name := range names {
+			allowed[name] = true
+		}
+		for _, name := range globalParams {
+			allowed[name] = true
+		}
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			if !strict {
+				return next
+			}
+			return func(c echo.Context) error {
+				var unknown []string
+				for name := range c.QueryParams() {
+					if !allowed[name] {
+						unknown = append(unknown, "'"+name+"'")
+					}
+				}
+				if len(unknown) > 0 {
+					sort.Strings(unknown)
+					return fmt.Errorf("%w: %s", ErrUnknownParam, strings.Join(unknown, ", "))
+				}
+				return next(c)
+			}
+		}
+	}
+}
@@ -0,0 +1 @@
+DROP TABLE tb_province_tags;
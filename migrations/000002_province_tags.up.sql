@@ -0,0 +1,32 @@
+--
+-- Table Definition: province tags
+--
+CREATE TABLE tb_province_tags (
+    province_id int NOT NULL REFERENCES tb_provinces (id) ON DELETE CASCADE,
+    tag varchar(50) NOT NULL,
+    PRIMARY KEY (province_id, tag)
+);
+
+
+--
+-- Data for table `tb_province_tags`
+--
+INSERT INTO tb_province_tags(province_id, tag)
+  VALUES  (2,	'northern'),
+          (3,	'northern'),
+          (4,	'northern'),
+          (5,	'northern'),
+          (6,	'northern'),
+          (7,	'northern'),
+          (8,	'northern'),
+          (9,	'northern'),
+          (18,	'northern'),
+          (1,	'central'),
+          (10,	'central'),
+          (11,	'central'),
+          (12,	'central'),
+          (13,	'central'),
+          (14,	'southern'),
+          (15,	'southern'),
+          (16,	'southern'),
+          (17,	'southern');
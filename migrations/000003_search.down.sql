@@ -0,0 +1,3 @@
+ALTER TABLE tb_cities DROP COLUMN search_doc;
+
+ALTER TABLE tb_provinces DROP COLUMN search_doc;
@@ -0,0 +1,20 @@
+--
+-- Full-text search documents over province and city names. The English
+-- name is stemmed, the Lao name is indexed as-is.
+--
+ALTER TABLE tb_provinces
+    ADD COLUMN search_doc tsvector GENERATED ALWAYS AS (
+        to_tsvector('english', coalesce(name_english, '')) ||
+        to_tsvector('simple', coalesce(name, ''))
+    ) STORED;
+
+CREATE INDEX tb_provinces_search_doc_idx ON tb_provinces USING GIN (search_doc);
+
+
+ALTER TABLE tb_cities
+    ADD COLUMN search_doc tsvector GENERATED ALWAYS AS (
+        to_tsvector('english', coalesce(name_english, '')) ||
+        to_tsvector('simple', coalesce(name, ''))
+    ) STORED;
+
+CREATE INDEX tb_cities_search_doc_idx ON tb_cities USING GIN (search_doc);
@@ -0,0 +1,10 @@
+--
+-- Province boundaries as WGS 84 multipolygons, used by map viewport queries.
+-- Provinces without a boundary never intersect anything.
+--
+CREATE EXTENSION IF NOT EXISTS postgis;
+
+ALTER TABLE tb_provinces
+    ADD COLUMN boundary geometry(MultiPolygon, 4326);
+
+CREATE INDEX tb_provinces_boundary_idx ON tb_provinces USING GIST (boundary);
@@ -0,0 +1 @@
+ALTER TABLE tb_provinces DROP COLUMN region;
@@ -0,0 +1,21 @@
+--
+-- Regions group provinces above the province level, e.g. "North".
+-- Provinces without a region are listed as "Unassigned".
+--
+ALTER TABLE tb_provinces
+    ADD COLUMN region varchar(50);
+
+CREATE INDEX tb_provinces_region_idx ON tb_provinces (region);
+
+
+--
+-- Data for column `region`, following the regional tags
+--
+UPDATE tb_provinces SET region = 'North'
+  WHERE id IN (SELECT province_id FROM tb_province_tags WHERE tag = 'northern');
+
+UPDATE tb_provinces SET region = 'Central'
+  WHERE id IN (SELECT province_id FROM tb_province_tags WHERE tag = 'central');
+
+UPDATE tb_provinces SET region = 'South'
+  WHERE id IN (SELECT province_id FROM tb_province_tags WHERE tag = 'southern');
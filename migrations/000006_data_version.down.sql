@@ -0,0 +1,9 @@
+DROP TRIGGER tb_province_tags_data_version ON tb_province_tags;
+
+DROP TRIGGER tb_cities_data_version ON tb_cities;
+
+DROP TRIGGER tb_provinces_data_version ON tb_provinces;
+
+DROP FUNCTION bump_data_version();
+
+DROP TABLE tb_data_version;
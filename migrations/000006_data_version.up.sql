@@ -0,0 +1,30 @@
+--
+-- A counter bumped by every write to the dataset, used as the ETag of the
+-- collections. A counter rather than max(updated_at) across rows so that
+-- deletes move it forward too.
+--
+CREATE TABLE tb_data_version (
+    version bigint NOT NULL
+);
+
+INSERT INTO tb_data_version(version) VALUES (1);
+
+
+CREATE FUNCTION bump_data_version() RETURNS trigger AS $$
+BEGIN
+    UPDATE tb_data_version SET version = version + 1;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER tb_provinces_data_version
+    AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON tb_provinces
+    FOR EACH STATEMENT EXECUTE FUNCTION bump_data_version();
+
+CREATE TRIGGER tb_cities_data_version
+    AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON tb_cities
+    FOR EACH STATEMENT EXECUTE FUNCTION bump_data_version();
+
+CREATE TRIGGER tb_province_tags_data_version
+    AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON tb_province_tags
+    FOR EACH STATEMENT EXECUTE FUNCTION bump_data_version();
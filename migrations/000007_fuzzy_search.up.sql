@@ -0,0 +1,5 @@
+--
+-- Trigram similarity for fuzzy searches over English province names, e.g.
+-- finding "Champasak" from "champassak".
+--
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
@@ -0,0 +1 @@
+ALTER TABLE tb_cities DROP COLUMN active;
@@ -0,0 +1,7 @@
+--
+-- Cities can be deactivated, e.g. once merged into another, which hides
+-- them from the cities of their province unless include_inactive=true is
+-- given.
+--
+ALTER TABLE tb_cities
+    ADD COLUMN active boolean NOT NULL DEFAULT true;
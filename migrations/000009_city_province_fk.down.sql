@@ -0,0 +1 @@
+ALTER TABLE tb_cities DROP CONSTRAINT tb_cities_province_id_fkey;
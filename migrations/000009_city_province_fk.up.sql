@@ -0,0 +1,10 @@
+--
+-- Cities must belong to an existing province. Deleting provinces checks
+-- that they have no cities; with the key, a city inserted concurrently
+-- waits for the deletion to commit and then fails, rather than being left
+-- without its province. Existing cities are not checked, so the migration
+-- runs on data with orphans too.
+--
+ALTER TABLE tb_cities
+    ADD CONSTRAINT tb_cities_province_id_fkey
+    FOREIGN KEY (province_id) REFERENCES tb_provinces (id) NOT VALID;
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// preferReturn returns the return preference of the request, "minimal" or
+// "representation", from its Prefer header (RFC 7240); it is empty when
+// none was given.
+func preferReturn(r *http.Request) string {
+	for _, header := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(header, ",") {
+			// Parameters of a preference follow a ';' and are ignored.
+			token, _, _ := strings.Cut(pref, ";")
+			name, value, ok := strings.Cut(strings.TrimSpace(token), "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(name), "return") {
+				continue
+			}
+			switch value = strings.Trim(strings.TrimSpace(value), `"`); value {
+			case "minimal", "representation":
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+// writeResult sends the result of a write, pointing to the written
+// resource with the Location header. With "Prefer: return=minimal" the
+// body is left out and the response is a 204.
+func writeResult(c echo.Context, status int, location string, v any) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderLocation, location)
+	switch preferReturn(c.Request()) {
+	case "minimal":
+		res.Header().Set("Preference-Applied", "return=minimal")
+		return c.NoContent(http.StatusNoContent)
+	case "representation":
+		res.Header().Set("Preference-Applied", "return=representation")
+	}
+	return c.JSON(status, v)
+}
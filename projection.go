@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ErrInvalidSelect is an error when the select param cannot be parsed.
+var ErrInvalidSelect = errors.New("param: 'select' is not valid")
+
+// provinceFields and cityFields are the fields that can be selected.
+var (
+	provinceFields = []string{"id", "code", "name", "name_english", "region"}
+	cityFields     = []string{"id", "name", "name_english"}
+)
+
+// Projection selects which fields of a province, and of its cities, are
+// returned. It is parsed from a select param such as
+// "id,name,cities{id,name}".
+type Projection struct {
+	// Fields are the selected province fields.
+	Fields []string
+
+	// Cities are the selected city fields; nil when cities are not selected.
+	Cities []string
+}
+
+// parseProjection parses a select param. A bare "cities" selects every
+// city field.
+func parseProjection(s string) (*Projection, error) {
+	var p Projection
+	seen := make(map[string]bool)
+	for rest := s; ; {
+		i := strings.IndexAny(rest, ",{}")
+		if i < 0 {
+			i = len(rest)
+		}
+		name := strings.TrimSpace(rest[:i])
+		rest = rest[i:]
+		if name == "" {
+			return nil, fmt.Errorf("%w: expected a field name", ErrInvalidSelect)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%w: field '%s' is selected more than once", ErrInvalidSelect, name)
+		}
+		seen[name] = true
+
+		switch {
+		case name == "cities" && strings.HasPrefix(rest, "{"):
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: missing '}' after 'cities{'", ErrInvalidSelect)
+			}
+			fields, err := parseFields(rest[1:end], cityFields, "city field")
+			if err != nil {
+				return nil, err
+			}
+			p.Cities = fields
+			rest = rest[end+1:]
+		case name == "cities":
+			p.Cities = cityFields
+		case strings.HasPrefix(rest, "{"):
+			return nil, fmt.Errorf("%w: field '%s' has no sub-fields", ErrInvalidSelect, name)
+		case contains(provinceFields, name):
+			p.Fields = append(p.Fields, name)
+		default:
+			return nil, fmt.Errorf("%w: unknown field '%s'", ErrInvalidSelect, name)
+		}
+
+		if rest == "" {
+			return &p, nil
+		}
+		if rest[0] != ',' {
+			return nil, fmt.Errorf("%w: unexpected '%c'", ErrInvalidSelect, rest[0])
+		}
+		rest = rest[1:]
+	}
+}
+
+// parseFields parses a comma-separated list of the allowed fields.
+func parseFields(s string, allowed []string, kind string) ([]string, error) {
+	var fields []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+			return nil, fmt.Errorf("%w: expected a %s name", ErrInvalidSelect, kind)
+		case contains(fields, name):
+			return nil, fmt.Errorf("%w: %s '%s' is selected more than once", ErrInvalidSelect, kind, name)
+		case !contains(allowed, name):
+			return nil, fmt.Errorf("%w: unknown %s '%s'", ErrInvalidSelect, kind, name)
+		}
+		fields = append(fields, name)
+	}
+	return fields, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// columns returns the province columns to load. The id is always loaded as
+// cities are looked up by it.
+func (p *Projection) columns() []string {
+	columns := []string{"id"}
+	for _, f := range p.Fields {
+		if f != "id" {
+			columns = append(columns, f)
+		}
+	}
+	return columns
+}
+
+// province returns the selected fields of a province.
+func (p *Projection) province(v Province) map[string]any {
+	m := make(map[string]any, len(p.Fields)+1)
+	for _, f := range p.Fields {
+		switch f {
+		case "id":
+			m[f] = v.ID
+		case "code":
+			m[f] = v.Code
+		case "name":
+			m[f] = v.Name
+		case "name_english":
+			m[f] = v.NameEnglish
+		case "region":
+			m[f] = v.Region
+		}
+	}
+	if p.Cities != nil {
+		cities := make([]map[string]any, len(v.Cities))
+		for i, c := range v.Cities {
+			cities[i] = p.city(c)
+		}
+		m["cities"] = cities
+	}
+	return m
+}
+
+// provinces returns the selected fields of each province.
+func (p *Projection) provinces(provinces []Province) []map[string]any {
+	out := make([]map[string]any, len(provinces))
+	for i, v := range provinces {
+		out[i] = p.province(v)
+	}
+	return out
+}
+
+// city returns the selected fields of a city.
+func (p *Projection) city(c City) map[string]any {
+	m := make(map[string]any, len(p.Cities))
+	for _, f := range p.Cities {
+		switch f {
+		case "id":
+			m[f] = c.ID
+		case "name":
+			m[f] = c.Name
+		case "name_english":
+			m[f] = c.NameEnglish
+		}
+	}
+	return m
+}
+
+// selectParam reads the select param; it returns nil when it is not set.
+func selectParam(c echo.Context) (*Projection, error) {
+	v, err := queryParam(c, "select")
+	if err != nil || v == "" {
+		return nil, err
+	}
+	return parseProjection(v)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protobufContentType is the media type of Protocol Buffers responses. The
+// messages are defined in proto/province.proto.
+const protobufContentType = "application/x-protobuf"
+
+// acceptsProtobuf reports whether the Accept header of r prefers Protocol
+// Buffers over JSON. JSON wins ties, so it stays the default.
+func acceptsProtobuf(r *http.Request) bool {
+	var pb, js float64
+	for _, part := range strings.Split(r.Header.Get(echo.HeaderAccept), ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case protobufContentType, "application/protobuf":
+			if q > pb {
+				pb = q
+			}
+		case echo.MIMEApplicationJSON, "application/*", "*/*":
+			if q > js {
+				js = q
+			}
+		}
+	}
+	return pb > js
+}
+
+// provinceResponse sends v, a Province or a list of them, as Protocol
+// Buffers when the client prefers them and as JSON otherwise.
+func provinceResponse(c echo.Context, v any) error {
+	varyAccept(c.Response().Header())
+	if !acceptsProtobuf(c.Request()) {
+		return c.JSON(http.StatusOK, v)
+	}
+	var b []byte
+	switch v := v.(type) {
+	case *Province:
+		b = appendProvince(nil, *v)
+	case []Province:
+		b = appendProvinceList(nil, v)
+	default:
+		return c.JSON(http.StatusOK, v)
+	}
+	return c.Blob(http.StatusOK, protobufContentType, b)
+}
+
+// appendProvinceList appends the ProvinceList message of provinces to b.
+func appendProvinceList(b []byte, provinces []Province) []byte {
+	for _, p := range provinces {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendProvince(nil, p))
+	}
+	return b
+}
+
+// appendProvince appends the Province message of p to b. Fields holding
+// their zero value are left out, as proto3 does.
+func appendProvince(b []byte, p Province) []byte {
+	b = appendInt(b, 1, p.ID)
+	b = appendString(b, 2, p.Code)
+	b = appendString(b, 3, p.Name)
+	b = appendString(b, 4, p.NameEnglish)
+	b = appendString(b, 5, p.Region)
+	for _, c := range p.Cities {
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendCity(nil, c))
+	}
+	if len(p.CityIDs) > 0 {
+		var packed []byte
+		for _, id := range p.CityIDs {
+			packed = protowire.AppendVarint(packed, uint64(int32(id)))
+		}
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		b = protowire.AppendBytes(b, packed)
+	}
+	for _, tag := range p.Tags {
+		b = protowire.AppendTag(b, 8, protowire.BytesType)
+		b = protowire.AppendString(b, tag)
+	}
+	return b
+}
+
+// appendCity appends the City message of c to b.
+func appendCity(b []byte, c City) []byte {
+	b = appendInt(b, 1, c.ID)
+	b = appendString(b, 2, c.Name)
+	b = appendString(b, 3, c.NameEnglish)
+	return b
+}
+
+// appendInt appends an int32 field unless v is 0. Ids fit an int32 as they
+// come from Postgres integer columns.
+func appendInt(b []byte, num protowire.Number, v int) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(int32(v)))
+}
+
+// appendString appends a string field unless s is empty.
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
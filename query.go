@@ -0,0 +1,143 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ProvinceQuery is the body of POST /provinces/query, holding the filters
+// of GET /provinces for clients whose filters would not fit a URL.
+type ProvinceQuery struct {
+	Search    string   `json:"search"`
+	Lang      string   `json:"lang"`
+	Fuzzy     bool     `json:"fuzzy"`
+	HasCities *bool    `json:"has_cities"`
+	Codes     []string `json:"codes"`
+	Tag       string   `json:"tag"`
+	Region    string   `json:"region"`
+
+	// IncludeInactive keeps the inactive cities, as include_inactive does.
+	IncludeInactive bool `json:"include_inactive"`
+
+	// Sort lists the sort fields as the sort query parameter does, e.g.
+	// "region,-name".
+	Sort  string `json:"sort"`
+	Order string `json:"order"`
+
+	Pagination struct {
+		// Limit, when set, paginates the list like the limit query
+		// parameter.
+		Limit  *int `json:"limit"`
+		Offset int  `json:"offset"`
+	} `json:"pagination"`
+}
+
+// filter checks the query and builds the filter GET /provinces would from
+// the same values, with the same caps.
+func (q ProvinceQuery) filter() (ProvinceFilter, error) {
+	f := ProvinceFilter{
+		Search:    strings.TrimSpace(q.Search),
+		Lang:      searchLang(q.Lang),
+		Fuzzy:     q.Fuzzy,
+		HasCities: q.HasCities,
+		Region:    strings.TrimSpace(q.Region),
+
+		InactiveCities: q.IncludeInactive,
+	}
+	for _, code := range q.Codes {
+		if code = strings.TrimSpace(code); code != "" {
+			f.Codes = append(f.Codes, code)
+		}
+	}
+	if err := checkBatchSize(len(f.Codes), "codes"); err != nil {
+		return f, err
+	}
+
+	var verrs ValidationErrors
+	if q.Tag != "" {
+		tag, err := tagParam(q.Tag)
+		if err != nil {
+			verrs = append(verrs, FieldError{"tag", "must be 1-50 characters of lowercase letters, digits or '-'"})
+		}
+		f.Tag = tag
+	}
+	var desc bool
+	switch q.Order {
+	case "", "asc":
+	case "desc":
+		desc = true
+	default:
+		verrs = append(verrs, FieldError{"order", "must be 'asc' or 'desc'"})
+	}
+	if q.Sort != "" {
+		sorts, err := sortList(q.Sort, desc, provinceSortFields)
+		if err != nil {
+			verrs = append(verrs, FieldError{"sort", "must list fields among " + sortFieldNames(provinceSortFields)})
+		}
+		f.Sort = sorts
+	}
+	if limit := q.Pagination.Limit; limit != nil {
+		if *limit > math.MaxInt32 {
+			verrs = append(verrs, FieldError{"pagination.limit", "is out of range"})
+		}
+		f.Page.setLimit(*limit)
+	}
+	switch offset := q.Pagination.Offset; {
+	case offset > math.MaxInt32:
+		verrs = append(verrs, FieldError{"pagination.offset", "is out of range"})
+	case offset > 0:
+		f.Page.Offset = offset
+	}
+	if len(verrs) > 0 {
+		return f, verrs
+	}
+	return f, nil
+}
+
+// sortFieldNames lists the allowed sort fields, for error messages.
+func sortFieldNames(allowed map[string]bool) string {
+	names := make([]string, 0, len(allowed))
+	for name := range allowed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Query lists the provinces matching the filters of the request body, as
+// GET /provinces does for those of the query. The include query parameter
+// is read as for GET /provinces. As a POST response cannot be linked to,
+// pagination is reported with X-Total-Count only.
+func (h *handler) Query(c echo.Context) error {
+	var body ProvinceQuery
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	f, err := body.filter()
+	if err != nil {
+		return err
+	}
+	if err := checkOffset(c, f.Page.Offset); err != nil {
+		return err
+	}
+	include, err := includeParam(c, "cities", "tags")
+	if err != nil {
+		return err
+	}
+	inc := Include{Tags: include["tags"], Cities: include["cities"], InactiveCities: f.InactiveCities}
+	provinces, total, err := h.service.GetProvinces(c.Request().Context(), f, inc)
+	if err != nil {
+		return err
+	}
+	if f.Page.Limit > 0 {
+		c.Response().Header().Set("X-Total-Count", strconv.Itoa(total))
+	}
+	if !f.Page.Adjusted {
+		return provinceResponse(c, provinces)
+	}
+	return pageJSON(c, f.Page, provinces)
+}
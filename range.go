@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ErrRangeNotSatisfiable is an error when a Range header starts past the
+// last item of a list.
+var ErrRangeNotSatisfiable = errors.New("range: the list has no items in the requested range")
+
+// itemsRange is a range of list items, e.g. "Range: items=0-49". Last is
+// -1 for an open-ended range such as "items=50-".
+type itemsRange struct {
+	First int
+	Last  int
+}
+
+// parseItemsRange parses a Range header in the items unit. Headers that
+// are missing, in another unit or malformed are reported as not ok, in
+// which case the Range header is ignored as RFC 9110 allows.
+func parseItemsRange(header string) (itemsRange, bool) {
+	if !strings.HasPrefix(header, "items=") {
+		return itemsRange{}, false
+	}
+	spec := strings.TrimPrefix(header, "items=")
+	if strings.Contains(spec, ",") {
+		return itemsRange{}, false
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return itemsRange{}, false
+	}
+	r := itemsRange{Last: -1}
+	var err error
+	if r.First, err = strconv.Atoi(first); err != nil || r.First < 0 {
+		return itemsRange{}, false
+	}
+	if last != "" {
+		if r.Last, err = strconv.Atoi(last); err != nil || r.Last < r.First {
+			return itemsRange{}, false
+		}
+	}
+	return r, true
+}
+
+// page returns the page of the range, at most maxPageSize items long.
+func (r itemsRange) page() Page {
+	limit := maxPageSize
+	if r.Last >= 0 && r.Last-r.First+1 < limit {
+		limit = r.Last - r.First + 1
+	}
+	return Page{Limit: limit, Offset: r.First}
+}
+
+// getCityRange sends the cities of a province in the requested range as a
+// 206 with a Content-Range header, for clients that paginate with Range
+// headers rather than limit and offset.
+func (h *handler) getCityRange(c echo.Context, rng itemsRange) error {
+	id, err := intParam(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	sort, err := sortParams(c, citySortFields, "name")
+	if err != nil {
+		return err
+	}
+	inactive, err := boolParam(c, "include_inactive")
+	if err != nil {
+		return err
+	}
+	page := rng.page()
+	cities, total, err := h.service.GetCityPage(c.Request().Context(), id, sort, page, inactive)
+	if err != nil {
+		return err
+	}
+	header := c.Response().Header()
+	header.Set("Accept-Ranges", "items")
+	if len(cities) == 0 {
+		header.Set("Content-Range", fmt.Sprintf("items */%d", total))
+		return ErrRangeNotSatisfiable
+	}
+	header.Set("Content-Range", fmt.Sprintf("items %d-%d/%d", page.Offset, page.Offset+len(cities)-1, total))
+	return c.JSON(http.StatusPartialContent, cities)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// RetryRepository retries the reads of the wrapped repository when they fail
+// with a transient error such as a dropped connection or a failover. Writes
+// are passed through untouched since retrying them could apply them twice.
+type RetryRepository struct {
+	RepositoryIface
+
+	attempts int
+	backoff  time.Duration
+}
+
+// NewRetryRepository wraps repo so that reads are tried up to attempts
+// times, waiting backoff before the first retry and doubling it after.
+func NewRetryRepository(repo RepositoryIface, attempts int, backoff time.Duration) *RetryRepository {
+	return &RetryRepository{RepositoryIface: repo, attempts: attempts, backoff: backoff}
+}
+
+// Unwrap returns the wrapped repository.
+func (r *RetryRepository) Unwrap() RepositoryIface {
+	return r.RepositoryIface
+}
+
+// transientPQCodes are the Postgres error codes worth retrying.
+var transientPQCodes = map[pq.ErrorCode]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"53300": true, // too_many_connections
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+}
+
+// isTransient reports whether err is likely to go away on retry.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Class 08 is connection_exception.
+		return pqErr.Code.Class() == "08" || transientPQCodes[pqErr.Code]
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.As(err, &netErr)
+}
+
+// retry calls fn until it succeeds, fails with a permanent error or the
+// attempts run out.
+func retry[T any](ctx context.Context, r *RetryRepository, fn func() (T, error)) (T, error) {
+	backoff := r.backoff
+	for attempt := 1; ; attempt++ {
+		v, err := fn()
+		if err == nil || attempt >= r.attempts || !isTransient(err) {
+			return v, err
+		}
+		select {
+		case <-ctx.Done():
+			return v, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (r *RetryRepository) GetProvinces(ctx context.Context, f ProvinceFilter) ([]Province, error) {
+	return retry(ctx, r, func() ([]Province, error) {
+		return r.RepositoryIface.GetProvinces(ctx, f)
+	})
+}
+
+func (r *RetryRepository) CountProvinces(ctx context.Context, f ProvinceFilter) (int, error) {
+	return retry(ctx, r, func() (int, error) {
+		return r.RepositoryIface.CountProvinces(ctx, f)
+	})
+}
+
+func (r *RetryRepository) GetProvincesByIDs(ctx context.Context, ids []int) ([]Province, error) {
+	return retry(ctx, r, func() ([]Province, error) {
+		return r.RepositoryIface.GetProvincesByIDs(ctx, ids)
+	})
+}
+
+func (r *RetryRepository) GetProvincesByCodes(ctx context.Context, codes []string) ([]Province, error) {
+	return retry(ctx, r, func() ([]Province, error) {
+		return r.RepositoryIface.GetProvincesByCodes(ctx, codes)
+	})
+}
+
+func (r *RetryRepository) GetProvinceByID(ctx context.Context, provinceID int) (Province, error) {
+	return retry(ctx, r, func() (Province, error) {
+		return r.RepositoryIface.GetProvinceByID(ctx, provinceID)
+	})
+}
+
+func (r *RetryRepository) GetProvincesWithin(ctx context.Context, bbox BBox) ([]Province, error) {
+	return retry(ctx, r, func() ([]Province, error) {
+		return r.RepositoryIface.GetProvincesWithin(ctx, bbox)
+	})
+}
+
+func (r *RetryRepository) GetCentroids(ctx context.Context) ([]Centroid, error) {
+	return retry(ctx, r, func() ([]Centroid, error) {
+		return r.RepositoryIface.GetCentroids(ctx)
+	})
+}
+
+func (r *RetryRepository) GetNearestProvinces(ctx context.Context, lng, lat float64, limit int) ([]NearbyProvince, error) {
+	return retry(ctx, r, func() ([]NearbyProvince, error) {
+		return r.RepositoryIface.GetNearestProvinces(ctx, lng, lat, limit)
+	})
+}
+
+func (r *RetryRepository) GetManifest(ctx context.Context) ([]ManifestEntry, error) {
+	return retry(ctx, r, func() ([]ManifestEntry, error) {
+		return r.RepositoryIface.GetManifest(ctx)
+	})
+}
+
+func (r *RetryRepository) GetProvincesByRegion(ctx context.Context) ([]Province, error) {
+	return retry(ctx, r, func() ([]Province, error) {
+		return r.RepositoryIface.GetProvincesByRegion(ctx)
+	})
+}
+
+func (r *RetryRepository) FindProvince(ctx context.Context, name, region string) (Province, error) {
+	return retry(ctx, r, func() (Province, error) {
+		return r.RepositoryIface.FindProvince(ctx, name, region)
+	})
+}
+
+func (r *RetryRepository) DataVersion(ctx context.Context) (string, error) {
+	return retry(ctx, r, func() (string, error) {
+		return r.RepositoryIface.DataVersion(ctx)
+	})
+}
+
+func (r *RetryRepository) ProvinceExists(ctx context.Context, provinceID int) (bool, error) {
+	return retry(ctx, r, func() (bool, error) {
+		return r.RepositoryIface.ProvinceExists(ctx, provinceID)
+	})
+}
+
+func (r *RetryRepository) GetProvinceByCode(ctx context.Context, code string) (Province, error) {
+	return retry(ctx, r, func() (Province, error) {
+		return r.RepositoryIface.GetProvinceByCode(ctx, code)
+	})
+}
+
+func (r *RetryRepository) Search(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	return retry(ctx, r, func() ([]SearchResult, error) {
+		return r.RepositoryIface.Search(ctx, query, limit)
+	})
+}
+
+func (r *RetryRepository) GetCities(ctx context.Context, provinceID int, sort Sort, page Page, inactive bool) ([]City, error) {
+	return retry(ctx, r, func() ([]City, error) {
+		return r.RepositoryIface.GetCities(ctx, provinceID, sort, page, inactive)
+	})
+}
+
+func (r *RetryRepository) GetCityNames(ctx context.Context, provinceID int, sort Sort, inactive bool) ([]string, error) {
+	return retry(ctx, r, func() ([]string, error) {
+		return r.RepositoryIface.GetCityNames(ctx, provinceID, sort, inactive)
+	})
+}
+
+func (r *RetryRepository) GetCityIDs(ctx context.Context, provinceID int, inactive bool) ([]int, error) {
+	return retry(ctx, r, func() ([]int, error) {
+		return r.RepositoryIface.GetCityIDs(ctx, provinceID, inactive)
+	})
+}
+
+func (r *RetryRepository) GetAllCities(ctx context.Context, page Page, withProvince, inactive bool) ([]CityListing, error) {
+	return retry(ctx, r, func() ([]CityListing, error) {
+		return r.RepositoryIface.GetAllCities(ctx, page, withProvince, inactive)
+	})
+}
+
+func (r *RetryRepository) CountAllCities(ctx context.Context, inactive bool) (int, error) {
+	return retry(ctx, r, func() (int, error) {
+		return r.RepositoryIface.CountAllCities(ctx, inactive)
+	})
+}
+
+func (r *RetryRepository) CountCities(ctx context.Context, provinceID int, inactive bool) (int, error) {
+	return retry(ctx, r, func() (int, error) {
+		return r.RepositoryIface.CountCities(ctx, provinceID, inactive)
+	})
+}
+
+func (r *RetryRepository) GetCitiesByProvinceIDs(ctx context.Context, provinceIDs []int, inactive bool) (map[int][]City, error) {
+	return retry(ctx, r, func() (map[int][]City, error) {
+		return r.RepositoryIface.GetCitiesByProvinceIDs(ctx, provinceIDs, inactive)
+	})
+}
+
+func (r *RetryRepository) GetTags(ctx context.Context, provinceIDs ...int) (map[int][]string, error) {
+	return retry(ctx, r, func() (map[int][]string, error) {
+		return r.RepositoryIface.GetTags(ctx, provinceIDs...)
+	})
+}
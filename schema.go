@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// checkSchema verifies that the province and city tables exist and have
+// the columns the repository reads, so a missing migration fails at startup
+// instead of on the first request. Without a schema the tables are looked
+// up in the schemas of the search_path.
+func checkSchema(ctx context.Context, db *sql.DB, schema string, names TableNames) error {
+	required := map[string][]string{
+		names.Provinces: {"id", "name", "name_english", "code", "region"},
+		names.Cities:    {"id", "name", "name_english", "province_id"},
+	}
+	for _, table := range []string{names.Provinces, names.Cities} {
+		columns, err := tableColumns(ctx, db, schema, table)
+		if err != nil {
+			return err
+		}
+		if len(columns) == 0 {
+			return fmt.Errorf("table %s does not exist, have the migrations been run?", table)
+		}
+		var missing []string
+		for _, c := range required[table] {
+			if !columns[c] {
+				missing = append(missing, c)
+			}
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			return fmt.Errorf("table %s is missing columns: %s", table, strings.Join(missing, ", "))
+		}
+	}
+	return nil
+}
+
+// detectFeatures looks up the optional features of the database: the
+// active column of the cities and pg_trgm for fuzzy searches. It must run
+// before the repository serves queries.
+func (r *Repository) detectFeatures(ctx context.Context) error {
+	cityColumns, err := tableColumns(ctx, r.db.DB, r.schema, r.names.Cities)
+	if err != nil {
+		return err
+	}
+	r.cityActive = cityColumns["active"]
+	trgm, err := hasExtension(ctx, r.db.DB, "pg_trgm")
+	if err != nil {
+		return err
+	}
+	r.similarity = 0
+	if trgm {
+		r.similarity = r.fuzzyThreshold
+	} else {
+		fmt.Println("warning: pg_trgm is not installed, fuzzy searches fall back to substring matches")
+	}
+	return nil
+}
+
+// hasExtension reports whether the named extension is installed in the
+// database.
+func hasExtension(ctx context.Context, db *sql.DB, name string) (bool, error) {
+	var ok bool
+	err := db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = $1)`, name).Scan(&ok)
+	return ok, err
+}
+
+// tableColumns returns the set of columns of table; it is empty when the
+// table does not exist.
+func tableColumns(ctx context.Context, db *sql.DB, schema, table string) (map[string]bool, error) {
+	query := `SELECT column_name FROM information_schema.columns
+		WHERE table_name = $1 AND table_schema = ANY(current_schemas(false))`
+	args := []any{table}
+	if schema != "" {
+		query = `SELECT column_name FROM information_schema.columns
+			WHERE table_name = $1 AND table_schema = $2`
+		args = append(args, schema)
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
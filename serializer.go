@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// jsonSerializer encodes responses compactly unless pretty is set or the
+// request asks for ?pretty=true. Unlike Echo's default serializer it
+// ignores ?pretty=false and other values that are not true.
+type jsonSerializer struct {
+	echo.DefaultJSONSerializer
+
+	pretty bool
+}
+
+func (s jsonSerializer) Serialize(c echo.Context, i interface{}, indent string) error {
+	enc := json.NewEncoder(c.Response())
+	if pretty, err := strconv.ParseBool(c.QueryParam("pretty")); s.pretty || (err == nil && pretty) {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(i)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingRepository counts the lookups of provinces by id, which block
+// until release is closed or their context is done. The other methods are
+// left to the nil RepositoryIface.
+type countingRepository struct {
+	RepositoryIface
+
+	calls   int32
+	release chan struct{}
+
+	// ctxs receives the context of each lookup.
+	ctxs chan context.Context
+}
+
+func (r *countingRepository) GetProvinceByID(ctx context.Context, provinceID int) (Province, error) {
+	atomic.AddInt32(&r.calls, 1)
+	r.ctxs <- ctx
+	select {
+	case <-r.release:
+		return Province{ID: provinceID, Name: "Vientiane"}, nil
+	case <-ctx.Done():
+		return Province{}, ctx.Err()
+	}
+}
+
+func newCountingRepository() *countingRepository {
+	return &countingRepository{release: make(chan struct{}), ctxs: make(chan context.Context, 100)}
+}
+
+// waitForWaiters waits until n requests wait for the only lookup of s.
+func waitForWaiters(t *testing.T, s *Service, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		var got int
+		for _, l := range s.lookups {
+			got += l.waiters
+		}
+		s.mu.Unlock()
+		if got == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%d requests did not join the lookup", n)
+}
+
+func TestGetProvinceByIDSharesConcurrentLookups(t *testing.T) {
+	repo := newCountingRepository()
+	s := NewService(repo, ServiceConfig{})
+
+	const n = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, err := s.GetProvinceByID(context.Background(), 1, Include{}, Sort{})
+			if err == nil && p.Name != "Vientiane" {
+				err = errors.New("unexpected province " + p.Name)
+			}
+			errs <- err
+		}()
+	}
+	waitForWaiters(t, s, n)
+	close(repo.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := atomic.LoadInt32(&repo.calls); calls != 1 {
+		t.Errorf("got %d lookups, want 1", calls)
+	}
+}
+
+func TestGetProvinceByIDCancelsLookupWithoutWaiters(t *testing.T) {
+	repo := newCountingRepository()
+	s := NewService(repo, ServiceConfig{})
+
+	parent := context.WithValue(context.Background(), traceKey{}, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	first, cancelFirst := context.WithCancel(parent)
+	second, cancelSecond := context.WithCancel(context.Background())
+	done := make(chan error, 2)
+	go func() {
+		_, err := s.GetProvinceByID(first, 1, Include{}, Sort{})
+		done <- err
+	}()
+	lookup := <-repo.ctxs
+	go func() {
+		_, err := s.GetProvinceByID(second, 1, Include{}, Sort{})
+		done <- err
+	}()
+	waitForWaiters(t, s, 2)
+
+	if got := traceparent(lookup); got != traceparent(parent) {
+		t.Errorf("lookup traceparent = %q, want %q", got, traceparent(parent))
+	}
+	cancelFirst()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if err := lookup.Err(); err != nil {
+		t.Fatalf("lookup canceled with a request still waiting: %v", err)
+	}
+	cancelSecond()
+	<-done
+	select {
+	case <-lookup.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookup not canceled once every request left")
+	}
+
+	// The next request starts a new lookup.
+	close(repo.release)
+	if _, err := s.GetProvinceByID(context.Background(), 1, Include{}, Sort{}); err != nil {
+		t.Fatal(err)
+	}
+	if calls := atomic.LoadInt32(&repo.calls); calls != 2 {
+		t.Errorf("got %d lookups, want 2", calls)
+	}
+}
+
+func TestGetProvinceByIDLookupKeepsDeadline(t *testing.T) {
+	repo := newCountingRepository()
+	s := NewService(repo, ServiceConfig{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	want, _ := ctx.Deadline()
+	go s.GetProvinceByID(ctx, 1, Include{}, Sort{})
+	lookup := <-repo.ctxs
+	if got, ok := lookup.Deadline(); !ok || !got.Equal(want) {
+		t.Errorf("lookup deadline = %v, %t, want %v", got, ok, want)
+	}
+	<-lookup.Done()
+}
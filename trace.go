@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// traceparentHeader and tracestateHeader carry the W3C trace context of a
+// request.
+const (
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+)
+
+// traceKey is the context key of the traceparent of a request.
+type traceKey struct{}
+
+// traceContext keeps the W3C trace context of the requests, so that their
+// log lines and queries can be correlated with the trace of the caller.
+// The traceparent is stored in the request context; an invalid one is
+// dropped along with the tracestate, as the spec requires, so that it is
+// neither logged nor passed on.
+func traceContext() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			parent := req.Header.Get(traceparentHeader)
+			if parent == "" {
+				return next(c)
+			}
+			if !validTraceparent(parent) {
+				req.Header.Del(traceparentHeader)
+				req.Header.Del(tracestateHeader)
+				return next(c)
+			}
+			// Only the fields of version 00 are kept, as the others were
+			// not validated.
+			ctx := context.WithValue(req.Context(), traceKey{}, parent[:55])
+			c.SetRequest(req.WithContext(ctx))
+			return next(c)
+		}
+	}
+}
+
+// validTraceparent reports whether v is a traceparent header:
+// version-traceid-parentid-flags in lower-case hex, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01. Versions after
+// 00 may add fields, which are ignored.
+func validTraceparent(v string) bool {
+	if len(v) < 55 || (len(v) > 55 && (v[:2] == "00" || v[55] != '-')) {
+		return false
+	}
+	fields := strings.Split(v[:55], "-")
+	if len(fields) != 4 || fields[0] == "ff" {
+		return false
+	}
+	for i, n := range []int{2, 32, 16, 2} {
+		if len(fields[i]) != n || !isLowerHex(fields[i]) {
+			return false
+		}
+	}
+	// All-zero trace and parent ids are invalid.
+	return strings.Trim(fields[1], "0") != "" && strings.Trim(fields[2], "0") != ""
+}
+
+func isLowerHex(s string) bool {
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// traceparent returns the traceparent stored in ctx by traceContext.
+func traceparent(ctx context.Context) string {
+	v, _ := ctx.Value(traceKey{}).(string)
+	return v
+}
+
+// tracedDB adds the traceparent of the request, when there is one, to the
+// statements it runs as a trailing comment in the sqlcommenter format, so
+// that they can be matched with the trace in the database logs and in
+// pg_stat_activity. The traceparent was validated, so it cannot end the
+// comment. The statements of transactions are sent as is.
+type tracedDB struct {
+	*sql.DB
+}
+
+// traced appends the trace comment of ctx to q.
+func traced(ctx context.Context, q string) string {
+	if parent := traceparent(ctx); parent != "" {
+		return q + " /*traceparent='" + parent + "'*/"
+	}
+	return q
+}
+
+func (db tracedDB) QueryContext(ctx context.Context, q string, args ...any) (*sql.Rows, error) {
+	return db.DB.QueryContext(ctx, traced(ctx, q), args...)
+}
+
+func (db tracedDB) QueryRowContext(ctx context.Context, q string, args ...any) *sql.Row {
+	return db.DB.QueryRowContext(ctx, traced(ctx, q), args...)
+}
+
+func (db tracedDB) ExecContext(ctx context.Context, q string, args ...any) (sql.Result, error) {
+	return db.DB.ExecContext(ctx, traced(ctx, q), args...)
+}